@@ -1,12 +1,25 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/k1ng440/rolling-hash/pkg/backup"
+	"github.com/k1ng440/rolling-hash/pkg/batch"
+	"github.com/k1ng440/rolling-hash/pkg/bundle"
 	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/k1ng440/rolling-hash/pkg/dirsig"
+	"github.com/k1ng440/rolling-hash/pkg/dirsync"
 	"github.com/k1ng440/rolling-hash/pkg/files"
+	"github.com/k1ng440/rolling-hash/pkg/store"
 )
 
 func main() {
@@ -17,12 +30,45 @@ func main() {
 
 	switch mode := strings.ToLower(os.Args[1]); mode {
 	case "signature", "sig":
-		if len(os.Args) != 4 {
+		flags := flag.NewFlagSet("signature", flag.ExitOnError)
+		perm := addModeFlag(flags, "permission of signature-file")
+		encrypt := flags.Bool("encrypt", false, "encrypt signature-file with the key given by -key or -passphrase-file")
+		keys := addKeyFlags(flags)
+		flags.Parse(os.Args[2:])
+
+		arg := flags.Args()
+		if len(arg) != 2 {
 			printHelp()
 			return 
 		}
 
-		arg := os.Args[2:]
+		key, err := keys.output(*encrypt)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if info, err := os.Stat(arg[0]); err == nil && info.IsDir() {
+			if key != nil {
+				fmt.Println("directory signatures cannot be encrypted")
+				os.Exit(1)
+			}
+
+			manifest, err := dirsig.Build(arg[0], delta.DefaultBlockSize)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			err = manifest.Write(arg[1])
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("root %x\n", manifest.RootHash())
+			return
+		}
 
 		oldFile, err := files.ReadFile(arg[0])
 		if err != nil {
@@ -35,20 +81,49 @@ func main() {
 			os.Exit(1)
 		}
 
-		err = files.WriteSignaturesToFile(arg[1], sigs)
+		err = files.WriteSignaturesToFileWithOptions(arg[1], sigs, &files.SignatureOptions{Key: key, Mode: *perm})
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 
 	case "delta":
-		if len(os.Args) != 5 {
+		flags := flag.NewFlagSet("delta", flag.ExitOnError)
+		compression := flags.String("compress", "none", "compress literals with flate, zlib or gzip")
+		perLiteral := flags.Bool("per-literal", false, "compress every literal on its own")
+		dictionary := flags.Bool("dict", false, "prime every literal with the old file, needs old-file and per literal flate")
+		inPlace := flags.Bool("inplace", false, "make the delta safe to apply in place without extra memory")
+		perm := addModeFlag(flags, "permission of delta-file")
+		encrypt := flags.Bool("encrypt", false, "encrypt delta-file with the key given by -key or -passphrase-file")
+		keys := addKeyFlags(flags)
+		flags.Parse(os.Args[2:])
+
+		arg := flags.Args()
+		if len(arg) != 3 && len(arg) != 4 {
 			printHelp()
-			return 
+			return
 		}
-		arg := os.Args[2:]
 
-		sigs, err := files.ReadSignaturesFromFile(arg[0])
+		opts := &files.DeltaOptions{PerLiteral: *perLiteral, Mode: *perm}
+		c, err := files.ParseCompression(*compression)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		opts.Compression = c
+
+		key, err := keys.key()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if opts.Key, err = keys.output(*encrypt); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		sigs, err := files.ReadSignaturesFromFileWithKey(arg[0], key)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -60,18 +135,811 @@ func main() {
 			os.Exit(1)
 		}
 
-		deltas, err := delta.GenerateDelta(newFile, delta.DefaultBlockSize, sigs)
+		patch, err := delta.GeneratePatch(newFile, delta.DefaultBlockSize, sigs)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		// both files are local, narrow down the literals using the old file
+		if len(arg) == 4 {
+			basis, err := files.ReadFileAt(arg[3])
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			defer basis.Close()
+
+			patch, err = refinePatch(basis, patch)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			if *dictionary {
+				opts.Basis = basis
+			}
+		} else if *dictionary {
+			fmt.Println("-dict needs the old file")
+			os.Exit(1)
+		}
+
+		if *inPlace {
+			err = makeInPlace(arg[1], patch)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+
+		err = files.WriteDeltaWithOptions(arg[2], patch, opts)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
+	case "patch":
+		flags := flag.NewFlagSet("patch", flag.ExitOnError)
+		verify := flags.String("verify", "", "check every block copied from old-file against this signature-file")
+		report := flags.String("report", "", "with -verify, write the target ranges to fetch in full to this file")
+		inPlace := flags.Bool("inplace", false, "rewrite old-file instead of writing new-file")
+		resume := flags.Bool("resume", false, "keep a journal beside new-file and continue an interrupted patch")
+		workers := flags.Int("workers", 0, "apply the delta with this many concurrent workers")
+		perm := addModeFlag(flags, "permission of new-file and report-file")
+		trustedFile := flags.String("trusted", "", "refuse deltas not signed with the public key in this file")
+		keys := addKeyFlags(flags)
+		flags.Parse(os.Args[2:])
+
+		arg := flags.Args()
+		if (!*inPlace && len(arg) != 3) || (*inPlace && len(arg) != 2) {
+			printHelp()
+			return
+		}
+
+		if *inPlace && *resume {
+			fmt.Println("-resume can not be used with -inplace")
+			os.Exit(1)
+		}
+
+		if *workers > 0 && (*inPlace || *resume) {
+			fmt.Println("-workers can not be used with -inplace or -resume")
+			os.Exit(1)
+		}
+
+		key, err := keys.key()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		var trusted ed25519.PublicKey
+		if *trustedFile != "" {
+			if trusted, err = files.ReadPublicKeyFile(*trustedFile); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+
+		basis, err := files.ReadFileAt(arg[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer basis.Close()
+
+		patch, err := files.ReadDeltaWithOptions(arg[1], &files.ReadOptions{Basis: basis, Key: key, Trusted: trusted})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if *verify != "" {
+			err = verifyBlocks(*verify, *report, *perm, basis, patch, key)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+
+		if *inPlace {
+			basis.Close()
+			err = files.PatchFileInPlace(arg[0], patch)
+		} else {
+			err = files.PatchFileWithOptions(arg[2], basis, patch, &files.PatchOptions{
+				Mode:      *perm,
+				Workers:   *workers,
+				Resumable: *resume,
+			})
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "compose":
+		flags := flag.NewFlagSet("compose", flag.ExitOnError)
+		compression := flags.String("compress", "none", "compress literals with flate, zlib or gzip")
+		perLiteral := flags.Bool("per-literal", false, "compress every literal on its own")
+		perm := addModeFlag(flags, "permission of composed-delta-file")
+		basisFile := flags.String("basis", "", "old file of the first delta, needed to read deltas written with -dict")
+		encrypt := flags.Bool("encrypt", false, "encrypt composed-delta-file with the key given by -key or -passphrase-file")
+		keys := addKeyFlags(flags)
+		flags.Parse(os.Args[2:])
+
+		arg := flags.Args()
+		if len(arg) < 3 {
+			printHelp()
+			return
+		}
+
+		opts := &files.DeltaOptions{PerLiteral: *perLiteral, Mode: *perm}
+		c, err := files.ParseCompression(*compression)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		opts.Compression = c
+
+		key, err := keys.key()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if opts.Key, err = keys.output(*encrypt); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		var basis io.ReaderAt
+		if *basisFile != "" {
+			f, err := files.ReadFileAt(*basisFile)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			basis = f
+		}
+
+		patch, err := files.ReadDeltaWithKey(arg[0], basis, key)
+		if err != nil {
+			fmt.Printf("%s: %v\n", arg[0], basisHint(err))
+			os.Exit(1)
+		}
+
+		for _, name := range arg[1 : len(arg)-1] {
+			// every delta was generated against the target composed so far
+			var target io.ReaderAt
+			if basis != nil {
+				if target, err = delta.NewPatchedReader(basis, patch); err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			}
+
+			next, err := files.ReadDeltaWithKey(name, target, key)
+			if err != nil {
+				fmt.Printf("%s: %v\n", name, basisHint(err))
+				os.Exit(1)
+			}
+
+			patch, err = delta.Compose(patch, next)
+			if err != nil {
+				fmt.Printf("%s: %v\n", name, err)
+				os.Exit(1)
+			}
+		}
+
+		err = files.WriteDeltaWithOptions(arg[len(arg)-1], patch, opts)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "invert":
+		flags := flag.NewFlagSet("invert", flag.ExitOnError)
+		perm := addModeFlag(flags, "permission of inverse-delta-file")
+		encrypt := flags.Bool("encrypt", false, "encrypt inverse-delta-file with the key given by -key or -passphrase-file")
+		keys := addKeyFlags(flags)
+		flags.Parse(os.Args[2:])
+
+		arg := flags.Args()
+		if len(arg) != 3 {
+			printHelp()
+			return
+		}
+
+		key, err := keys.key()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		output, err := keys.output(*encrypt)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		basis, err := files.ReadFileAt(arg[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer basis.Close()
+
+		patch, err := files.ReadDeltaWithKey(arg[1], basis, key)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		inverse, err := delta.Invert(basis, patch)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		err = files.WriteDeltaWithOptions(arg[2], inverse, &files.DeltaOptions{Key: output, Mode: *perm})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "store":
+		if len(os.Args) < 3 {
+			printHelp()
+			return
+		}
+
+		err := storeCommand(strings.ToLower(os.Args[2]), os.Args[3:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "sync":
+		flags := flag.NewFlagSet("sync", flag.ExitOnError)
+		checksum := flags.Bool("checksum", false, "compare the content of files instead of their size and modification time")
+		flags.Parse(os.Args[2:])
+
+		arg := flags.Args()
+		if len(arg) != 2 {
+			printHelp()
+			return
+		}
+
+		stats, err := dirsync.Sync(arg[0], arg[1], &dirsync.Options{Checksum: *checksum})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%d files: %d unchanged, %d created, %d patched, %d deleted\n",
+			stats.Files, stats.Unchanged, stats.Created, stats.Patched, stats.Deleted)
+		fmt.Printf("%d bytes literal, %d bytes matched\n", stats.Literal, stats.Matched)
+	case "bundle":
+		if len(os.Args) < 3 {
+			printHelp()
+			return
+		}
+
+		err := bundleCommand(strings.ToLower(os.Args[2]), os.Args[3:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "write-batch", "read-batch":
+		err := batchCommand(mode, os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "backup", "restore", "snapshots", "diff":
+		err := backupCommand(mode, os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "keygen":
+		if len(os.Args) != 4 {
+			printHelp()
+			return
+		}
+
+		err := files.WriteSigningKeys(os.Args[2], os.Args[3])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "sign":
+		if len(os.Args) != 4 {
+			printHelp()
+			return
+		}
+
+		priv, err := files.ReadPrivateKeyFile(os.Args[2])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		err = files.SignFile(os.Args[3], priv)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "verify":
+		if len(os.Args) != 4 {
+			printHelp()
+			return
+		}
 
-		files.WriteDelta(arg[2], deltas)
+		pub, err := files.ReadPublicKeyFile(os.Args[2])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		err = files.VerifyFile(os.Args[3], pub)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("signature ok")
+	case "compare":
+		if len(os.Args) != 4 {
+			printHelp()
+			return
+		}
+
+		identical, err := compareCommand(os.Args[2], os.Args[3])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if !identical {
+			os.Exit(1)
+		}
+	case "needs":
+		flags := flag.NewFlagSet("needs", flag.ExitOnError)
+		basisFile := flags.String("basis", "", "old file of the delta, needed to read deltas written with -dict")
+		keys := addKeyFlags(flags)
+		flags.Parse(os.Args[2:])
+
+		arg := flags.Args()
+		if len(arg) != 1 {
+			printHelp()
+			return
+		}
+
+		key, err := keys.key()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		var basis io.ReaderAt
+		if *basisFile != "" {
+			f, err := files.ReadFileAt(*basisFile)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			basis = f
+		}
+
+		patch, err := files.ReadDeltaWithKey(arg[0], basis, key)
+		if err != nil {
+			fmt.Println(basisHint(err))
+			os.Exit(1)
+		}
+
+		ranges, total := delta.BasisRanges(patch)
+		for _, r := range ranges {
+			fmt.Printf("%d %d %d\n", r.Start, r.End, r.Len())
+		}
+		fmt.Printf("total %d bytes in %d ranges\n", total, len(ranges))
 	default: 
 		printHelp()
 	}
 }
 
+// basisHint points at the -basis flag when a delta can not be read without its old file
+func basisHint(err error) error {
+	if errors.Is(err, files.ErrBasisRequired) {
+		return fmt.Errorf("%w, pass the old file with -basis", err)
+	}
+
+	return err
+}
+
+// fileMode is the flag setting the permission of the written files
+type fileMode os.FileMode
+
+// addModeFlag adds the -mode flag to flags, defaulting to files.DefaultFileMode
+func addModeFlag(flags *flag.FlagSet, usage string) *os.FileMode {
+	mode := files.DefaultFileMode
+	flags.Var((*fileMode)(&mode), "mode", usage)
+	return &mode
+}
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%#o", os.FileMode(*m))
+}
+
+func (m *fileMode) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid permission %q", value)
+	}
+
+	*m = fileMode(mode)
+	return nil
+}
+
+// keyFlags select the key of encrypted signature and delta files
+type keyFlags struct {
+	keyFile        *string
+	passphraseFile *string
+}
+
+func addKeyFlags(flags *flag.FlagSet) *keyFlags {
+	return &keyFlags{
+		keyFile:        flags.String("key", "", "key file of encrypted files, 32 bytes or 64 hex digits"),
+		passphraseFile: flags.String("passphrase-file", "", "derive the key of encrypted files from the passphrase in this file"),
+	}
+}
+
+// key returns the key given by the flags, nil when none is given
+func (k *keyFlags) key() (*files.Key, error) {
+	switch {
+	case *k.keyFile != "" && *k.passphraseFile != "":
+		return nil, errors.New("-key can not be used with -passphrase-file")
+	case *k.keyFile != "":
+		return files.ReadKeyFile(*k.keyFile)
+	case *k.passphraseFile != "":
+		return files.ReadPassphraseFile(*k.passphraseFile)
+	}
+
+	return nil, nil
+}
+
+// output returns the key encrypting the output file, nil unless encrypt is set
+func (k *keyFlags) output(encrypt bool) (*files.Key, error) {
+	if !encrypt {
+		return nil, nil
+	}
+
+	key, err := k.key()
+	if err == nil && key == nil {
+		err = errors.New("-encrypt needs -key or -passphrase-file")
+	}
+
+	return key, err
+}
+
+// bundleCommand runs the create, apply and list commands of update bundles
+func bundleCommand(command string, args []string) error {
+	flags := flag.NewFlagSet("bundle "+command, flag.ExitOnError)
+	trustedFile := flags.String("trusted", "", "refuse bundles not signed with the public key in this file")
+	perm := addModeFlag(flags, "permission of the bundle file")
+	flags.Parse(args)
+
+	arg := flags.Args()
+	usage := map[string]int{"create": 3, "apply": 2, "list": 1}
+	if n, ok := usage[command]; !ok || len(arg) != n {
+		printHelp()
+		return nil
+	}
+
+	if command == "create" {
+		manifest, err := bundle.CreateWithMode(arg[2], arg[0], arg[1], *perm)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%d files changed\n", len(manifest.Entries))
+		return nil
+	}
+
+	var trusted ed25519.PublicKey
+	if *trustedFile != "" {
+		var err error
+		if trusted, err = files.ReadPublicKeyFile(*trustedFile); err != nil {
+			return err
+		}
+	}
+
+	b, err := bundle.Open(arg[len(arg)-1], trusted)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	if command == "apply" {
+		return b.Apply(arg[0])
+	}
+
+	for _, entry := range b.Manifest.Entries {
+		fmt.Printf("%-7s %v %8d %s\n", entry.Action, entry.Mode, entry.Length, entry.Path)
+	}
+
+	return nil
+}
+
+// batchCommand runs the write-batch and read-batch commands
+func batchCommand(command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	trustedFile := flags.String("trusted", "", "refuse batches not signed with the public key in this file")
+	perm := addModeFlag(flags, "permission of the batch file")
+	flags.Parse(args)
+
+	arg := flags.Args()
+	var stats *batch.Stats
+	var err error
+	switch {
+	case command == "write-batch" && len(arg) == 3:
+		stats, err = batch.WriteWithMode(arg[2], arg[0], arg[1], *perm)
+
+	case command == "read-batch" && len(arg) == 2:
+		var trusted ed25519.PublicKey
+		if *trustedFile != "" {
+			if trusted, err = files.ReadPublicKeyFile(*trustedFile); err != nil {
+				return err
+			}
+		}
+
+		stats, err = batch.Apply(arg[1], arg[0], trusted)
+
+	default:
+		printHelp()
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d removed, %d created, %d patched, %d metadata updates\n",
+		stats.Removed, stats.Created, stats.Patched, stats.Metadata)
+	fmt.Printf("%d bytes literal\n", stats.Literal)
+	return nil
+}
+
+// storeCommand runs the put, get and log commands of the version store
+func storeCommand(command string, args []string) error {
+	flags := flag.NewFlagSet("store "+command, flag.ExitOnError)
+	keyframes := flags.Int("keyframes", store.DefaultKeyframeInterval, "keep every n-th version in full")
+	perm := addModeFlag(flags, "permission of the written files")
+	keys := addKeyFlags(flags)
+	flags.Parse(args)
+
+	arg := flags.Args()
+	usage := map[string]int{"put": 3, "get": 4, "log": 2}
+	if n, ok := usage[command]; !ok || len(arg) != n {
+		printHelp()
+		return nil
+	}
+
+	s, err := store.New(arg[0])
+	if err != nil {
+		return err
+	}
+	s.KeyframeInterval = *keyframes
+	s.Mode = *perm
+	if s.Key, err = keys.key(); err != nil {
+		return err
+	}
+
+	switch command {
+	case "put":
+		fi, err := files.ReadFile(arg[2])
+		if err != nil {
+			return err
+		}
+
+		v, err := s.Put(arg[1], fi)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s version %d\n", arg[1], v.Number)
+
+	case "get":
+		number, err := strconv.Atoi(arg[2])
+		if err != nil {
+			return fmt.Errorf("invalid version %q", arg[2])
+		}
+
+		r, err := s.Get(arg[1], number)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		return files.WriteFileWithMode(arg[3], r, *perm)
+
+	case "log":
+		versions, err := s.List(arg[1])
+		if err != nil {
+			return err
+		}
+
+		for _, v := range versions {
+			kind := "delta"
+			if v.Keyframe || v == versions[len(versions)-1] {
+				kind = "full"
+			}
+			fmt.Printf("%d %s %d %s %x\n", v.Number, v.Time.Format(time.RFC3339), v.Size, kind, v.Hash)
+		}
+	}
+
+	return nil
+}
+
+// backupCommand runs the backup, restore, snapshots and diff commands
+func backupCommand(command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	keyFile := flags.String("key", "", "encrypt the repository with the secret in this file")
+	flags.Parse(args)
+
+	arg := flags.Args()
+	usage := map[string]int{"backup": 2, "restore": 3, "snapshots": 1, "diff": 3}
+	if len(arg) != usage[command] {
+		printHelp()
+		return nil
+	}
+
+	var repo *backup.Repository
+	var err error
+	if *keyFile != "" {
+		secret, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+
+		repo, err = backup.OpenEncrypted(arg[0], secret)
+		if err != nil {
+			return err
+		}
+	} else if repo, err = backup.Open(arg[0]); err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	switch command {
+	case "backup":
+		snap, stats, err := repo.Backup(arg[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("snapshot %s saved: %d files, %d unchanged, %d bytes read\n", snap.ID, stats.Files, stats.Unchanged, stats.Read)
+
+	case "restore":
+		snap, err := repo.Snapshot(arg[1])
+		if err != nil {
+			return err
+		}
+
+		return repo.Restore(snap, arg[2])
+
+	case "snapshots":
+		snapshots, err := repo.Snapshots()
+		if err != nil {
+			return err
+		}
+
+		for _, snap := range snapshots {
+			fmt.Printf("%s %s %s\n", snap.ID, snap.Time.Format(time.RFC3339), snap.Root)
+		}
+
+	case "diff":
+		a, err := repo.Snapshot(arg[1])
+		if err != nil {
+			return err
+		}
+
+		b, err := repo.Snapshot(arg[2])
+		if err != nil {
+			return err
+		}
+
+		for _, change := range backup.Diff(a, b) {
+			fmt.Printf("%s %s\n", change.Kind, change.Path)
+		}
+	}
+
+	return nil
+}
+
+// refinePatch rescans the literals of the patch with smaller blocks and extends
+// the matches byte by byte against the old file
+func refinePatch(basis io.ReaderAt, patch *delta.Patch) (*delta.Patch, error) {
+	refinements, err := delta.Refinements(patch, delta.DefaultBlockSize/delta.DefaultRefineFactor)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := delta.SignRefinements(basis, refinements); err != nil {
+		return nil, err
+	}
+
+	patch, err = delta.RefinePatch(patch, refinements)
+	if err != nil {
+		return nil, err
+	}
+
+	return patch, delta.ExtendMatches(patch, basis)
+}
+
+// makeInPlace turns the copies of the patch that can not be ordered in place
+// into literals read from the new file
+func makeInPlace(newFilename string, patch *delta.Patch) error {
+	target, err := files.ReadFileAt(newFilename)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	return delta.MakeInPlace(patch, target)
+}
+
+// verifyBlocks checks the blocks copied from basis against the signature file and
+// writes the target ranges to fetch in full to the report file when set
+func verifyBlocks(sigFilename, reportFilename string, mode os.FileMode, basis io.ReaderAt, patch *delta.Patch, key *files.Key) error {
+	sigs, err := files.ReadSignaturesFromFileWithKey(sigFilename, key)
+	if err != nil {
+		return err
+	}
+
+	err = delta.VerifyBlocks(basis, patch, sigs)
+	var mismatch *delta.BlockMismatchError
+	if errors.As(err, &mismatch) && reportFilename != "" {
+		if err := files.WriteRangesWithMode(reportFilename, mismatch.Ranges, mode); err != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// compareCommand prints the differences between two directory signatures and
+// reports whether the trees are identical
+func compareCommand(aFilename, bFilename string) (bool, error) {
+	a, err := dirsig.Read(aFilename)
+	if err != nil {
+		return false, err
+	}
+
+	b, err := dirsig.Read(bFilename)
+	if err != nil {
+		return false, err
+	}
+
+	diffs, err := dirsig.Compare(a, b)
+	if err != nil {
+		return false, err
+	}
+
+	if len(diffs) == 0 {
+		fmt.Printf("identical %x\n", a.RootHash())
+		return true, nil
+	}
+
+	for _, diff := range diffs {
+		if len(diff.Blocks) == 0 {
+			fmt.Printf("%s %s\n", diff.Kind, diff.Path)
+			continue
+		}
+
+		blocks := make([]string, len(diff.Blocks))
+		for i, block := range diff.Blocks {
+			blocks[i] = strconv.Itoa(block)
+		}
+		fmt.Printf("%s %s blocks %s\n", diff.Kind, diff.Path, strings.Join(blocks, ","))
+	}
+
+	return false, nil
+}
+
 func printHelp() {
 	menu := `
 *******             **  ** **                    **      **                   **     
@@ -85,8 +953,31 @@ func printHelp() {
 			---- Asaduzzaman Pavel ----
 
 Arguments: 
-  - signature old-file signature-file
-  - delta signature-file new-file delta-file
+  - signature [-mode perm] [-encrypt] [-key key-file | -passphrase-file file] old-file signature-file
+  - signature old-dir signature-file
+  - compare signature-file signature-file
+  - delta [-mode perm] [-compress flate|zlib|gzip] [-per-literal] [-dict] [-inplace] [-encrypt] [-key key-file | -passphrase-file file] signature-file new-file delta-file [old-file]
+  - patch [-mode perm] [-resume | -workers n] [-verify signature-file [-report report-file]] [-trusted public-key-file] [-key key-file | -passphrase-file file] old-file delta-file new-file
+  - patch -inplace [-verify signature-file [-report report-file]] [-trusted public-key-file] [-key key-file | -passphrase-file file] old-file delta-file
+  - compose [-mode perm] [-compress flate|zlib|gzip] [-per-literal] [-basis old-file] [-encrypt] [-key key-file | -passphrase-file file] delta-file delta-file [delta-file...] composed-delta-file
+  - invert [-mode perm] [-encrypt] [-key key-file | -passphrase-file file] old-file delta-file inverse-delta-file
+  - sync [-checksum] src-dir dst-dir
+  - bundle create [-mode perm] old-dir new-dir bundle-file
+  - bundle apply [-trusted public-key-file] dir bundle-file
+  - bundle list [-trusted public-key-file] bundle-file
+  - write-batch [-mode perm] ref-dir cur-dir batch-file
+  - read-batch [-trusted public-key-file] dir batch-file
+  - keygen private-key-file public-key-file
+  - sign private-key-file delta-file
+  - verify public-key-file delta-file
+  - needs [-basis old-file] [-key key-file | -passphrase-file file] delta-file
+  - store put [-keyframes n] [-key key-file | -passphrase-file file] store-dir name file
+  - store get [-mode perm] [-key key-file | -passphrase-file file] store-dir name version out-file
+  - store log [-key key-file | -passphrase-file file] store-dir name
+  - backup [-key key-file] repo-dir dir
+  - restore [-key key-file] repo-dir snapshot dir
+  - snapshots [-key key-file] repo-dir
+  - diff [-key key-file] repo-dir snapshot snapshot
 `
 	fmt.Println(menu)
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cliEnv makes the test binary run the command line tool instead of the tests
+const cliEnv = "ROLLING_HASH_CLI"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(cliEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// run runs the tool with args and returns its output
+func run(t *testing.T, args ...string) (string, error) {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), cliEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestEmptyBasis(t *testing.T) {
+	dir := t.TempDir()
+	oldFile := filepath.Join(dir, "old")
+	newFile := filepath.Join(dir, "new")
+	data := []byte("the same line repeated, the same line repeated, the same line repeated")
+	require.NoError(t, ioutil.WriteFile(oldFile, nil, 0644))
+	require.NoError(t, ioutil.WriteFile(newFile, data, 0644))
+
+	sigFile := filepath.Join(dir, "sig")
+	out, err := run(t, "signature", oldFile, sigFile)
+	require.NoError(t, err, out)
+
+	deltaFile := filepath.Join(dir, "delta")
+	out, err = run(t, "delta", sigFile, newFile, deltaFile)
+	require.NoError(t, err, out)
+
+	patched := filepath.Join(dir, "patched")
+	out, err = run(t, "patch", oldFile, deltaFile, patched)
+	require.NoError(t, err, out)
+
+	res, err := ioutil.ReadFile(patched)
+	require.NoError(t, err)
+	assert.Equal(t, data, res)
+}
+
+func TestComposeDictionary(t *testing.T) {
+	dir := t.TempDir()
+	lorem, err := ioutil.ReadFile("testdata/lorem-ipsum.new")
+	require.NoError(t, err)
+
+	versions := make([]string, 3)
+	for i := range versions {
+		data := append([]byte{}, lorem...)
+		for j := i; j < len(data); j += 97 {
+			data[j] = '#'
+		}
+		versions[i] = filepath.Join(dir, "v"+strconv.Itoa(i))
+		require.NoError(t, ioutil.WriteFile(versions[i], data, 0644))
+	}
+
+	deltas := make([]string, 2)
+	for i := range deltas {
+		sigFile := filepath.Join(dir, "sig")
+		out, err := run(t, "signature", versions[i], sigFile)
+		require.NoError(t, err, out)
+
+		deltas[i] = filepath.Join(dir, "delta"+strconv.Itoa(i))
+		out, err = run(t, "delta", "-compress", "flate", "-per-literal", "-dict", sigFile, versions[i+1], deltas[i], versions[i])
+		require.NoError(t, err, out)
+	}
+
+	// the literals can not be read without the old file
+	composed := filepath.Join(dir, "composed")
+	out, err := run(t, "compose", deltas[0], deltas[1], composed)
+	require.Error(t, err)
+	assert.Contains(t, out, "-basis")
+
+	out, err = run(t, "needs", deltas[0])
+	require.Error(t, err)
+	assert.Contains(t, out, "-basis")
+
+	out, err = run(t, "needs", "-basis", versions[0], deltas[0])
+	require.NoError(t, err, out)
+
+	out, err = run(t, "compose", "-basis", versions[0], deltas[0], deltas[1], composed)
+	require.NoError(t, err, out)
+
+	patched := filepath.Join(dir, "patched")
+	out, err = run(t, "patch", versions[0], composed, patched)
+	require.NoError(t, err, out)
+
+	res, err := ioutil.ReadFile(patched)
+	require.NoError(t, err)
+	expected, err := ioutil.ReadFile(versions[2])
+	require.NoError(t, err)
+	assert.Equal(t, expected, res)
+}
+
+func TestComposeInvertEncrypt(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)), 0600))
+
+	oldFile := filepath.Join(dir, "old")
+	newFile := filepath.Join(dir, "new")
+	require.NoError(t, ioutil.WriteFile(oldFile, []byte(strings.Repeat("old content ", 100)), 0644))
+	require.NoError(t, ioutil.WriteFile(newFile, []byte(strings.Repeat("new content ", 100)), 0644))
+
+	sigFile := filepath.Join(dir, "sig")
+	out, err := run(t, "signature", "-encrypt", "-key", keyFile, oldFile, sigFile)
+	require.NoError(t, err, out)
+
+	deltaFile := filepath.Join(dir, "delta")
+	out, err = run(t, "delta", "-encrypt", "-key", keyFile, sigFile, newFile, deltaFile)
+	require.NoError(t, err, out)
+
+	// the key only decrypts the input unless -encrypt is given
+	for _, args := range [][]string{{"compose", deltaFile, deltaFile}, {"invert", oldFile, deltaFile}} {
+		plain := filepath.Join(dir, args[0]+".plain")
+		out, err = run(t, append(append([]string{args[0], "-key", keyFile}, args[1:]...), plain)...)
+		require.NoError(t, err, out)
+		out, err = run(t, "needs", plain)
+		require.NoError(t, err, out)
+
+		encrypted := filepath.Join(dir, args[0]+".encrypted")
+		out, err = run(t, append(append([]string{args[0], "-encrypt", "-key", keyFile}, args[1:]...), encrypted)...)
+		require.NoError(t, err, out)
+		out, err = run(t, "needs", encrypted)
+		require.Error(t, err, out)
+		out, err = run(t, "needs", "-key", keyFile, encrypted)
+		require.NoError(t, err, out)
+
+		out, err = run(t, append(append([]string{args[0], "-encrypt"}, args[1:]...), encrypted)...)
+		require.Error(t, err, out)
+	}
+}
@@ -0,0 +1,175 @@
+package backup
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/k1ng440/rolling-hash/pkg/chunkstore"
+)
+
+// Stats summarizes a backup
+type Stats struct {
+	Files int
+	// Unchanged files are taken from the previous snapshot without being read
+	Unchanged int
+	// Read is the number of bytes read from changed files
+	Read int64
+}
+
+// Backup walks the directory tree at root and saves a snapshot of it. Files with
+// the same size, modification time and inode as in the previous snapshot of
+// root are not read again, changed files only store the chunks not stored yet.
+func (r *Repository) Backup(root string) (*Snapshot, *Stats, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	previous, err := r.previous(root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	snap := &Snapshot{
+		Time: time.Now(),
+		Root: root,
+	}
+	stats := &Stats{}
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		entry := &Entry{
+			Path:    filepath.ToSlash(rel),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+			Inode:   inode(info),
+		}
+
+		switch {
+		case info.Mode().IsDir():
+
+		case info.Mode()&os.ModeSymlink != 0:
+			if entry.Link, err = os.Readlink(path); err != nil {
+				return err
+			}
+
+		case info.Mode().IsRegular():
+			entry.Size = info.Size()
+			stats.Files++
+
+			if prev, ok := previous[entry.Path]; ok && unchanged(prev, entry) {
+				if err := r.reuse(entry, prev); err != nil {
+					return err
+				}
+				stats.Unchanged++
+				break
+			}
+
+			if err := r.store(path, entry); err != nil {
+				return err
+			}
+			stats.Read += entry.Size
+
+		default:
+			// devices, sockets and pipes are not backed up
+			return nil
+		}
+
+		snap.Entries = append(snap.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the chunks must be on disk before a snapshot points at them
+	if err := r.chunks.Flush(); err != nil {
+		return nil, nil, err
+	}
+
+	if err := r.save(snap); err != nil {
+		return nil, nil, err
+	}
+
+	return snap, stats, nil
+}
+
+// previous returns the entries of the latest snapshot of root by path
+func (r *Repository) previous(root string) (map[string]*Entry, error) {
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]*Entry)
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if snapshots[i].Root != root {
+			continue
+		}
+
+		for _, entry := range snapshots[i].Entries {
+			entries[entry.Path] = entry
+		}
+		break
+	}
+
+	return entries, nil
+}
+
+// unchanged reports whether a file looks the same as in the previous snapshot
+func unchanged(prev, entry *Entry) bool {
+	return prev.Mode.IsRegular() &&
+		prev.Size == entry.Size &&
+		prev.ModTime.Equal(entry.ModTime) &&
+		prev.Inode == entry.Inode
+}
+
+// reuse takes the chunks of an unchanged file from the previous snapshot
+func (r *Repository) reuse(entry, prev *Entry) error {
+	for _, id := range prev.Chunks {
+		if err := r.chunks.Ref(id); err != nil {
+			return err
+		}
+	}
+
+	entry.Chunks = prev.Chunks
+	return nil
+}
+
+// store chunks the file at path and stores the new chunks
+func (r *Repository) store(path string, entry *Entry) error {
+	fi, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	w := chunkstore.NewDedupWriter(r.chunks, r.Chunker)
+	if _, err := io.Copy(w, fi); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	// the size actually read, the file may have changed since it was listed
+	entry.Size = w.Size()
+	entry.Chunks = w.IDs()
+	return nil
+}
@@ -0,0 +1,198 @@
+package backup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/k1ng440/rolling-hash/pkg/chunkstore"
+	"github.com/k1ng440/rolling-hash/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func assertTree(t *testing.T, root string, tree map[string][]byte) {
+	for name, data := range tree {
+		res, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		require.NoError(t, err, name)
+		assert.Equal(t, data, res, name)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	src := t.TempDir()
+	repo, err := Open(t.TempDir())
+	require.NoError(t, err)
+	defer repo.Close()
+
+	tree := map[string][]byte{
+		"a.txt":         []byte("The quick brown fox jumps over the lazy dog"),
+		"big.bin":       testutil.RandomBytes(1, 200*1024),
+		"sub/dir/c.bin": testutil.RandomBytes(2, 30*1024),
+	}
+	testutil.WriteTree(t, src, tree)
+	require.NoError(t, os.Symlink("a.txt", filepath.Join(src, "link")))
+
+	first, stats, err := repo.Backup(src)
+	require.NoError(t, err)
+	assert.Equal(t, &Stats{Files: 3, Read: 230*1024 + 43}, stats)
+
+	// change a few bytes of the big file, add and remove files
+	big := append([]byte{}, tree["big.bin"]...)
+	copy(big[100*1024:], "changed")
+	tree["big.bin"] = big
+	tree["new.txt"] = []byte("new file")
+	later := time.Now().Add(time.Hour)
+	testutil.WriteTree(t, src, map[string][]byte{"big.bin": big, "new.txt": tree["new.txt"]})
+	require.NoError(t, os.Chtimes(filepath.Join(src, "big.bin"), later, later))
+	require.NoError(t, os.Remove(filepath.Join(src, "a.txt")))
+
+	second, stats, err := repo.Backup(src)
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.Files)
+	assert.Equal(t, 1, stats.Unchanged)
+
+	snapshots, err := repo.Snapshots()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, first.ID, snapshots[0].ID)
+
+	found, err := repo.Snapshot(second.ID[:6])
+	require.NoError(t, err)
+	assert.Equal(t, second.Entries, found.Entries)
+
+	assert.Equal(t, []*Change{
+		{Path: "a.txt", Kind: Removed},
+		{Path: "big.bin", Kind: Modified},
+		{Path: "new.txt", Kind: Added},
+	}, Diff(first, second))
+
+	// both snapshots restore to their own tree
+	dst := t.TempDir()
+	require.NoError(t, repo.Restore(second, dst))
+	delete(tree, "a.txt")
+	assertTree(t, dst, tree)
+
+	link, err := os.Readlink(filepath.Join(dst, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "a.txt", link)
+
+	info, err := os.Stat(filepath.Join(dst, "big.bin"))
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(later))
+
+	dst = t.TempDir()
+	require.NoError(t, repo.Restore(first, dst))
+	assertTree(t, dst, map[string][]byte{"a.txt": []byte("The quick brown fox jumps over the lazy dog")})
+}
+
+func TestBackupStoresNewChunksOnly(t *testing.T) {
+	src := t.TempDir()
+	dir := t.TempDir()
+	repo, err := Open(dir)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	data := testutil.RandomBytes(1, 1024*1024)
+	testutil.WriteTree(t, src, map[string][]byte{"file": data})
+	_, _, err = repo.Backup(src)
+	require.NoError(t, err)
+
+	// an insertion in the middle of the file
+	changed := append(append(append([]byte{}, data[:500*1024]...), "inserted"...), data[500*1024:]...)
+	testutil.WriteTree(t, src, map[string][]byte{"file": changed})
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(src, "file"), later, later))
+
+	before := packsSize(t, dir)
+	_, _, err = repo.Backup(src)
+	require.NoError(t, err)
+	assert.Less(t, packsSize(t, dir)-before, int64(200*1024))
+}
+
+func packsSize(t *testing.T, dir string) int64 {
+	packs, err := filepath.Glob(filepath.Join(dir, chunksDir, "packs", "*"))
+	require.NoError(t, err)
+
+	size := int64(0)
+	for _, pack := range packs {
+		info, err := os.Stat(pack)
+		require.NoError(t, err)
+		size += info.Size()
+	}
+
+	return size
+}
+
+func TestBackupEncrypted(t *testing.T) {
+	src := t.TempDir()
+	dir := t.TempDir()
+	secret := bytes.Repeat([]byte{7}, chunkstore.SecretSize)
+
+	repo, err := OpenEncrypted(dir, secret)
+	require.NoError(t, err)
+
+	tree := map[string][]byte{"secret-name.txt": []byte("The quick brown fox jumps over the lazy dog")}
+	testutil.WriteTree(t, src, tree)
+
+	snap, _, err := repo.Backup(src)
+	require.NoError(t, err)
+
+	dst := t.TempDir()
+	require.NoError(t, repo.Restore(snap, dst))
+	assertTree(t, dst, tree)
+	require.NoError(t, repo.Close())
+
+	// neither names nor contents are readable from the repository
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "secret-name")
+		assert.NotContains(t, string(data), "quick")
+		return nil
+	})
+	require.NoError(t, err)
+
+	_, err = OpenEncrypted(dir, bytes.Repeat([]byte{8}, chunkstore.SecretSize))
+	assert.Error(t, err)
+}
+
+func TestRestorePath(t *testing.T) {
+	_, err := restorePath("dst", "../escape")
+	assert.Error(t, err)
+
+	path, err := restorePath("dst", "sub/file")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("dst", "sub", "file"), path)
+}
+
+func TestRestoreThroughSymlink(t *testing.T) {
+	repo, err := Open(t.TempDir())
+	require.NoError(t, err)
+	defer repo.Close()
+
+	outside := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(outside, "x"), []byte("outside"))
+	before := testutil.Snapshot(t, outside, true)
+
+	// a snapshot restoring entries through a symlink of its own
+	link := &Entry{Path: "a", Mode: os.ModeSymlink | 0777, Link: outside}
+	for _, entry := range []*Entry{
+		{Path: "a/x", Mode: 0644},
+		{Path: "a/d", Mode: os.ModeDir | 0755},
+		{Path: "a", Mode: os.ModeDir | 0777},
+	} {
+		dst := t.TempDir()
+		err := repo.Restore(&Snapshot{Entries: []*Entry{link, entry}}, dst)
+		assert.Error(t, err, entry.Path)
+	}
+
+	assert.Equal(t, before, testutil.Snapshot(t, outside, true))
+}
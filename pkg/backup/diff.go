@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"sort"
+
+	"github.com/k1ng440/rolling-hash/pkg/internal/utils"
+)
+
+// ChangeKind is the kind of difference of a path between two snapshots
+type ChangeKind = utils.ChangeKind
+
+const (
+	Added    = utils.Added
+	Removed  = utils.Removed
+	Modified = utils.Modified
+)
+
+// Change is a path differing between two snapshots
+type Change struct {
+	Path string
+	Kind ChangeKind
+}
+
+// Diff returns the paths added, removed or modified from a to b, sorted by path.
+// A path is modified when its type, permissions, content or link target changed.
+func Diff(a, b *Snapshot) []*Change {
+	before := make(map[string]*Entry)
+	for _, entry := range a.Entries {
+		before[entry.Path] = entry
+	}
+
+	changes := make([]*Change, 0)
+	for _, entry := range b.Entries {
+		prev, ok := before[entry.Path]
+		delete(before, entry.Path)
+
+		if !ok {
+			changes = append(changes, &Change{Path: entry.Path, Kind: Added})
+		} else if modified(prev, entry) {
+			changes = append(changes, &Change{Path: entry.Path, Kind: Modified})
+		}
+	}
+
+	for path := range before {
+		changes = append(changes, &Change{Path: path, Kind: Removed})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	return changes
+}
+
+func modified(a, b *Entry) bool {
+	if a.Mode != b.Mode || a.Size != b.Size || a.Link != b.Link || len(a.Chunks) != len(b.Chunks) {
+		return true
+	}
+
+	for i := range a.Chunks {
+		if a.Chunks[i] != b.Chunks[i] {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+
+package backup
+
+import (
+	"os"
+	"syscall"
+)
+
+// inode returns the inode number of the file, 0 when unknown
+func inode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+
+	return 0
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package backup
+
+import "os"
+
+// inode returns 0, inode numbers are not available on this platform
+func inode(info os.FileInfo) uint64 {
+	return 0
+}
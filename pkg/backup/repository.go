@@ -0,0 +1,206 @@
+// Package backup keeps snapshots of directory trees in a local repository.
+// File contents are split into chunks stored once in a chunk store, and every
+// snapshot is a manifest listing the files of the tree with their chunks.
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/k1ng440/rolling-hash/pkg/chunkstore"
+	"github.com/k1ng440/rolling-hash/pkg/files"
+)
+
+const (
+	chunksDir    = "chunks"
+	snapshotsDir = "snapshots"
+)
+
+// ErrSnapshotNotFound is returned when no snapshot matches an ID
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// Entry is a file, directory or symlink of a snapshot
+type Entry struct {
+	// Path is relative to the root of the snapshot, slash separated
+	Path    string
+	Mode    os.FileMode
+	ModTime time.Time
+	Size    int64
+	Inode   uint64
+	// Link is the target of a symlink
+	Link   string
+	Chunks []chunkstore.ID
+}
+
+// Snapshot is the manifest of a directory tree at a point in time
+type Snapshot struct {
+	// ID is the name of the manifest file, empty until saved
+	ID      string
+	Time    time.Time
+	Root    string
+	Entries []*Entry
+}
+
+// Repository holds the chunks and snapshots in a local directory
+type Repository struct {
+	dir    string
+	chunks *chunkstore.Store
+	// cipher seals the manifests of encrypted repositories
+	cipher *chunkstore.Cipher
+	// Chunker splits the files, content defined by default
+	Chunker chunkstore.Chunker
+}
+
+// Open opens the repository in dir, creating it when needed
+func Open(dir string) (*Repository, error) {
+	if err := os.MkdirAll(filepath.Join(dir, snapshotsDir), 0755); err != nil {
+		return nil, err
+	}
+
+	chunks, err := chunkstore.Open(filepath.Join(dir, chunksDir))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Repository{
+		dir:     dir,
+		chunks:  chunks,
+		Chunker: chunkstore.NewContentChunker(),
+	}, nil
+}
+
+// OpenEncrypted opens the repository in dir like Open, with the chunks and
+// snapshots encrypted using keys derived from secret
+func OpenEncrypted(dir string, secret []byte) (*Repository, error) {
+	if err := os.MkdirAll(filepath.Join(dir, snapshotsDir), 0755); err != nil {
+		return nil, err
+	}
+
+	c, err := chunkstore.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks, err := chunkstore.OpenEncrypted(filepath.Join(dir, chunksDir), secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Repository{
+		dir:     dir,
+		chunks:  chunks,
+		cipher:  c,
+		Chunker: chunkstore.NewContentChunker(),
+	}, nil
+}
+
+// Close flushes and closes the chunk store
+func (r *Repository) Close() error {
+	return r.chunks.Close()
+}
+
+// Snapshots returns the snapshots of the repository, oldest first
+func (r *Repository) Snapshots() ([]*Snapshot, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(r.dir, snapshotsDir))
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]*Snapshot, 0, len(entries))
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		snap, err := r.load(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		snapshots = append(snapshots, snap)
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+
+	return snapshots, nil
+}
+
+// Snapshot returns the snapshot whose ID starts with prefix
+func (r *Repository) Snapshot(prefix string) (*Snapshot, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(r.dir, snapshotsDir))
+	if err != nil {
+		return nil, err
+	}
+
+	found := ""
+	for _, entry := range entries {
+		if prefix == "" || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+
+		if found != "" {
+			return nil, fmt.Errorf("snapshot prefix %q is ambiguous", prefix)
+		}
+		found = entry.Name()
+	}
+
+	if found == "" {
+		return nil, ErrSnapshotNotFound
+	}
+
+	return r.load(found)
+}
+
+func (r *Repository) load(id string) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(filepath.Join(r.dir, snapshotsDir, id))
+	if err != nil {
+		return nil, err
+	}
+
+	if r.cipher != nil {
+		if data, err = r.cipher.OpenData(data); err != nil {
+			return nil, fmt.Errorf("reading snapshot %s: %w", id, err)
+		}
+	}
+
+	snap := &Snapshot{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(snap); err != nil {
+		return nil, fmt.Errorf("reading snapshot %s: %w", id, err)
+	}
+
+	snap.ID = id
+	return snap, nil
+}
+
+// save writes the snapshot, its ID is the hash of the stored manifest
+func (r *Repository) save(snap *Snapshot) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(snap); err != nil {
+		return err
+	}
+
+	data := buf.Bytes()
+	if r.cipher != nil {
+		var err error
+		if data, err = r.cipher.SealData(data); err != nil {
+			return err
+		}
+	}
+
+	sum := sha256.Sum256(data)
+	snap.ID = hex.EncodeToString(sum[:8])
+
+	return files.WriteFile(filepath.Join(r.dir, snapshotsDir, snap.ID), bytes.NewReader(data))
+}
@@ -0,0 +1,99 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/k1ng440/rolling-hash/pkg/chunkstore"
+	"github.com/k1ng440/rolling-hash/pkg/files"
+	"github.com/k1ng440/rolling-hash/pkg/internal/utils"
+)
+
+// Restore writes the tree of the snapshot to dst
+func (r *Repository) Restore(snap *Snapshot, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	dirs := make([]*Entry, 0)
+	for _, entry := range snap.Entries {
+		path, err := restorePath(dst, entry.Path)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case entry.Mode.IsDir():
+			if err := utils.CheckNotSymlink(path); err != nil {
+				return err
+			}
+
+			// writable until the files inside are restored
+			if err := os.MkdirAll(path, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, entry)
+
+		case entry.Mode&os.ModeSymlink != 0:
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			if err := os.Symlink(entry.Link, path); err != nil {
+				return err
+			}
+
+		default:
+			if err := files.WriteFile(path, chunkstore.NewReader(r.chunks, entry.Chunks)); err != nil {
+				return err
+			}
+
+			if err := restoreMetadata(path, entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	// deepest first, setting the time of a directory after its content
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path, err := restorePath(dst, dirs[i].Path)
+		if err != nil {
+			return err
+		}
+
+		if err := restoreMetadata(path, dirs[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func restoreMetadata(path string, entry *Entry) error {
+	// a symlink restored in place of the entry would be followed
+	if err := utils.CheckNotSymlink(path); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(path, entry.Mode.Perm()); err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, entry.ModTime, entry.ModTime)
+}
+
+// restorePath returns the path of an entry under dst, refusing paths leaving dst
+// either lexically or through a symlink restored before
+func restorePath(dst, path string) (string, error) {
+	local, err := utils.LocalPath(path)
+	if err != nil {
+		return "", fmt.Errorf("%w in snapshot", err)
+	}
+
+	if err := utils.CheckParents(dst, local); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dst, local), nil
+}
@@ -0,0 +1,562 @@
+// Package batch records the changes between a reference tree and the current
+// tree in a single batch file, like the batch mode of rsync. The deltas are
+// computed once and the batch is applied later to any number of replicas of the
+// reference tree.
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/k1ng440/rolling-hash/pkg/dirsig"
+	"github.com/k1ng440/rolling-hash/pkg/files"
+	"github.com/k1ng440/rolling-hash/pkg/internal/utils"
+)
+
+const (
+	// batchMagic starts the content of every batch
+	batchMagic = "RHBATCH1"
+	// batchVersion is the version of the batch file format
+	batchVersion = 1
+)
+
+var errInvalidBatch = errors.New("invalid batch file")
+
+// ErrReferenceMismatch is returned when the tree is not a replica of the reference tree of a batch
+var ErrReferenceMismatch = errors.New("tree does not match the reference tree of the batch")
+
+// OpType is the kind of a batch operation
+type OpType uint8
+
+const (
+	// OpEnd ends the operations of a batch
+	OpEnd OpType = iota
+	// OpRemove removes a file, symlink or directory with its content
+	OpRemove
+	// OpMkdir creates a directory, it is kept writable until its OpMetadata
+	OpMkdir
+	// OpSymlink creates or replaces a symlink
+	OpSymlink
+	// OpFile rebuilds a file from its reference version and the delta following the operation
+	OpFile
+	// OpMetadata sets the permissions and the modification time of a file or directory
+	OpMetadata
+)
+
+var opNames = map[OpType]string{
+	OpEnd:      "end",
+	OpRemove:   "remove",
+	OpMkdir:    "mkdir",
+	OpSymlink:  "symlink",
+	OpFile:     "file",
+	OpMetadata: "metadata",
+}
+
+func (t OpType) String() string {
+	if name, ok := opNames[t]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("op(%d)", uint8(t))
+}
+
+// Op is an operation of a batch
+type Op struct {
+	Type OpType
+	// Path is relative to the root of the tree, slash separated, empty for the root
+	Path    string
+	Mode    os.FileMode
+	ModTime time.Time
+	// Link is the target of a symlink
+	Link string
+}
+
+// Header describes a batch
+type Header struct {
+	Version   int
+	BlockSize int
+	// Reference is the root hash of the reference tree, see dirsig
+	Reference []byte
+}
+
+// Stats summarizes a batch
+type Stats struct {
+	Removed int
+	Created int
+	Patched int
+	// Metadata counts the files and directories whose permissions or time are set
+	Metadata int
+	// Literal is the number of bytes of the files not found in their reference version
+	Literal int64
+}
+
+// Write writes a batch updating replicas of the tree at refDir to the tree at
+// curDir. Regular files, directories and symlinks are recorded, with their
+// permissions and modification times.
+func Write(filename, refDir, curDir string) (*Stats, error) {
+	return WriteWithMode(filename, refDir, curDir, files.DefaultFileMode)
+}
+
+// WriteWithMode writes a batch like Write with the given permission
+func WriteWithMode(filename, refDir, curDir string, mode os.FileMode) (*Stats, error) {
+	ref, err := dirsig.Build(refDir, delta.DefaultBlockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := dirsig.Build(curDir, delta.DefaultBlockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{}
+	pr, pw := io.Pipe()
+	go func() {
+		bw := bufio.NewWriter(pw)
+		w := &writer{w: bw, enc: gob.NewEncoder(bw), refDir: refDir, curDir: curDir, blockSize: ref.BlockSize, stats: stats}
+		err := w.write(ref, cur)
+		if err == nil {
+			err = bw.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err = files.WriteFileWithMode(filename, pr, mode)
+	// stop the writer when the file could not be written
+	pr.CloseWithError(errors.New("batch file not written"))
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// writer encodes the operations of a batch
+type writer struct {
+	w         io.Writer
+	enc       *gob.Encoder
+	refDir    string
+	curDir    string
+	blockSize int
+	stats     *Stats
+}
+
+func (w *writer) write(ref, cur *dirsig.Manifest) error {
+	if _, err := w.w.Write([]byte(batchMagic)); err != nil {
+		return err
+	}
+
+	header := &Header{
+		Version:   batchVersion,
+		BlockSize: ref.BlockSize,
+		Reference: ref.RootHash(),
+	}
+	if err := w.enc.Encode(header); err != nil {
+		return err
+	}
+
+	if changed(ref.Root, cur.Root) {
+		if err := w.dir(ref.Root, cur.Root, ""); err != nil {
+			return err
+		}
+	}
+
+	return w.enc.Encode(&Op{Type: OpEnd})
+}
+
+// dir writes the operations updating the directory ref to cur. The directory is
+// made writable first and gets its metadata once its content is updated.
+func (w *writer) dir(ref, cur *dirsig.Node, p string) error {
+	if err := w.op(&Op{Type: OpMkdir, Path: p}); err != nil {
+		return err
+	}
+
+	var refChildren []*dirsig.Node
+	if ref != nil {
+		refChildren = ref.Children
+	}
+
+	// both children lists are sorted by name
+	i, j := 0, 0
+	for i < len(refChildren) || j < len(cur.Children) {
+		var r, c *dirsig.Node
+		switch {
+		case j == len(cur.Children) || (i < len(refChildren) && refChildren[i].Name < cur.Children[j].Name):
+			r = refChildren[i]
+			i++
+		case i == len(refChildren) || refChildren[i].Name > cur.Children[j].Name:
+			c = cur.Children[j]
+			j++
+		default:
+			r, c = refChildren[i], cur.Children[j]
+			i++
+			j++
+		}
+
+		if err := w.child(r, c, utils.JoinPath(p, nodeName(r, c))); err != nil {
+			return err
+		}
+	}
+
+	return w.metadata(cur, p)
+}
+
+func (w *writer) child(ref, cur *dirsig.Node, p string) error {
+	if ref != nil && (cur == nil || utils.FileKind(ref.Mode) != utils.FileKind(cur.Mode)) {
+		if err := w.op(&Op{Type: OpRemove, Path: p}); err != nil {
+			return err
+		}
+		w.stats.Removed++
+		ref = nil
+	}
+
+	if cur == nil || (ref != nil && !changed(ref, cur)) {
+		return nil
+	}
+
+	switch utils.FileKind(cur.Mode) {
+	case os.ModeDir:
+		return w.dir(ref, cur, p)
+
+	case os.ModeSymlink:
+		if ref != nil && ref.Link == cur.Link {
+			return nil
+		}
+		return w.op(&Op{Type: OpSymlink, Path: p, Link: cur.Link})
+	}
+
+	if ref != nil && sameContent(ref, cur) {
+		return w.metadata(cur, p)
+	}
+
+	return w.file(ref, cur, p)
+}
+
+// file writes the delta of a file from its reference version, if any
+func (w *writer) file(ref, cur *dirsig.Node, p string) error {
+	fi, err := os.Open(filepath.Join(w.curDir, filepath.FromSlash(p)))
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	var sigs []*delta.BlockSignature
+	var basis io.ReaderAt = bytes.NewReader(nil)
+	if ref != nil {
+		sigs = ref.Blocks
+
+		old, err := os.Open(filepath.Join(w.refDir, filepath.FromSlash(p)))
+		if err != nil {
+			return err
+		}
+		defer old.Close()
+		basis = old
+	}
+
+	patch, err := delta.GeneratePatchWithBasis(fi, w.blockSize, sigs, basis)
+	if err != nil {
+		return err
+	}
+
+	if ref == nil {
+		// added files are rebuilt from nothing
+		patch.BasisHash = nil
+		w.stats.Created++
+	} else {
+		w.stats.Patched++
+	}
+	w.stats.Literal += literalBytes(patch)
+
+	if err := w.op(&Op{Type: OpFile, Path: p, Mode: cur.Mode, ModTime: cur.ModTime}); err != nil {
+		return err
+	}
+
+	return files.EncodeDelta(w.w, patch, &files.DeltaOptions{Compression: files.CompressionFlate})
+}
+
+func (w *writer) metadata(node *dirsig.Node, p string) error {
+	w.stats.Metadata++
+	return w.op(&Op{Type: OpMetadata, Path: p, Mode: node.Mode, ModTime: node.ModTime})
+}
+
+func (w *writer) op(op *Op) error {
+	return w.enc.Encode(op)
+}
+
+// changed reports whether the tree under cur differs from the tree under ref,
+// modification times included except for symlinks
+func changed(ref, cur *dirsig.Node) bool {
+	if !bytes.Equal(ref.Hash, cur.Hash) {
+		return true
+	}
+
+	if utils.FileKind(cur.Mode) != os.ModeSymlink && !ref.ModTime.Equal(cur.ModTime) {
+		return true
+	}
+
+	for i, child := range cur.Children {
+		if changed(ref.Children[i], child) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameContent reports whether two files have the same blocks
+func sameContent(ref, cur *dirsig.Node) bool {
+	if ref.Size != cur.Size || len(ref.BlockHashes) != len(cur.BlockHashes) {
+		return false
+	}
+
+	for i, h := range cur.BlockHashes {
+		if !bytes.Equal(ref.BlockHashes[i], h) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func nodeName(ref, cur *dirsig.Node) string {
+	if cur != nil {
+		return cur.Name
+	}
+
+	return ref.Name
+}
+
+func literalBytes(patch *delta.Patch) int64 {
+	matched := int64(0)
+	for _, op := range patch.Ops {
+		if op.Type == delta.OpCopy {
+			matched += int64(op.Len())
+		}
+	}
+
+	return int64(patch.Size()) - matched
+}
+
+// Apply updates the tree at dir with a batch. The batch is read through once
+// and the tree is checked against the reference tree before anything is
+// changed. When trusted is set, batches not signed with it are refused, see
+// files.SignFile, signed batches are read into memory once and verified so that
+// exactly the verified bytes are applied. The files are replaced one by one: an
+// apply interrupted by an error leaves the tree partly updated, bundle applies
+// changes as a whole.
+func Apply(filename, dir string, trusted ed25519.PublicKey) (*Stats, error) {
+	var src io.ReadSeeker
+	if trusted != nil {
+		content, err := files.ReadSigned(filename, trusted)
+		if err != nil {
+			return nil, err
+		}
+
+		src = bytes.NewReader(content)
+	} else {
+		fi, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer fi.Close()
+
+		src = fi
+	}
+
+	// a truncated or corrupt batch is refused before the first change
+	header, err := scan(src, func(*Op, *delta.Patch) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := dirsig.Build(dir, header.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(manifest.RootHash(), header.Reference) {
+		return nil, ErrReferenceMismatch
+	}
+
+	stats := &Stats{}
+	_, err = scan(src, func(op *Op, patch *delta.Patch) error {
+		if err := apply(dir, op, patch, stats); err != nil {
+			return fmt.Errorf("%s %s: %w", op.Type, op.Path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// scan decodes the batch from the start of src and calls fn with every operation
+func scan(src io.ReadSeeker, fn func(*Op, *delta.Patch) error) (*Header, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// the reader reads single bytes, gob and the deltas do not read ahead
+	r, err := files.OpenSigned(src, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, len(batchMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != batchMagic {
+		return nil, errInvalidBatch
+	}
+
+	dec := gob.NewDecoder(r)
+	header := &Header{}
+	if err := dec.Decode(header); err != nil {
+		return nil, fmt.Errorf("reading batch: %w", err)
+	}
+
+	if header.Version != batchVersion || header.BlockSize <= 0 {
+		return nil, errInvalidBatch
+	}
+
+	for {
+		op := &Op{}
+		if err := dec.Decode(op); err != nil {
+			return nil, fmt.Errorf("reading batch: %w", err)
+		}
+
+		if op.Type == OpEnd {
+			return header, nil
+		}
+
+		if _, ok := opNames[op.Type]; !ok {
+			return nil, fmt.Errorf("unknown batch operation %s", op.Type)
+		}
+
+		if err := checkPath(op.Path, op.Type); err != nil {
+			return nil, err
+		}
+
+		var patch *delta.Patch
+		if op.Type == OpFile {
+			if _, patch, err = files.DecodeDelta(r, nil); err != nil {
+				return nil, fmt.Errorf("reading batch: %w", err)
+			}
+		}
+
+		if err := fn(op, patch); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// checkPath refuses paths leaving the tree, only directories apply to the root
+func checkPath(p string, t OpType) error {
+	if p == "" && (t == OpMkdir || t == OpMetadata) {
+		return nil
+	}
+
+	if _, err := utils.LocalPath(p); err != nil {
+		return fmt.Errorf("%w in batch", err)
+	}
+
+	return nil
+}
+
+func apply(dir string, op *Op, patch *delta.Patch, stats *Stats) error {
+	// the batch may have replaced a parent with a symlink leading out of dir
+	if err := utils.CheckParents(dir, filepath.FromSlash(op.Path)); err != nil {
+		return err
+	}
+
+	target := filepath.Join(dir, filepath.FromSlash(op.Path))
+
+	switch op.Type {
+	case OpRemove:
+		stats.Removed++
+		return os.RemoveAll(target)
+
+	case OpMkdir:
+		// writable until the content is updated
+		info, err := os.Lstat(target)
+		if os.IsNotExist(err) {
+			return os.Mkdir(target, 0700)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return errors.New("not a directory")
+		}
+
+		return os.Chmod(target, 0700)
+
+	case OpSymlink:
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return os.Symlink(op.Link, target)
+
+	case OpFile:
+		// the writer removes symlinks before writing files in their place
+		if err := utils.CheckNotSymlink(target); err != nil {
+			return err
+		}
+
+		if err := applyFile(target, patch, stats); err != nil {
+			return err
+		}
+
+		return setMetadata(target, op)
+
+	case OpMetadata:
+		if err := utils.CheckNotSymlink(target); err != nil {
+			return err
+		}
+
+		stats.Metadata++
+		return setMetadata(target, op)
+	}
+
+	return nil
+}
+
+// applyFile rebuilds the file from its current version, or from nothing when
+// it does not exist yet
+func applyFile(target string, patch *delta.Patch, stats *Stats) error {
+	stats.Literal += literalBytes(patch)
+
+	if patch.BasisHash == nil {
+		stats.Created++
+		return files.PatchFile(target, bytes.NewReader(nil), patch)
+	}
+
+	basis, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+
+	stats.Patched++
+	return files.PatchFile(target, basis, patch)
+}
+
+func setMetadata(target string, op *Op) error {
+	if err := os.Chmod(target, op.Mode.Perm()); err != nil {
+		return err
+	}
+
+	return os.Chtimes(target, op.ModTime, op.ModTime)
+}
@@ -0,0 +1,185 @@
+package batch
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/k1ng440/rolling-hash/pkg/files"
+	"github.com/k1ng440/rolling-hash/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// trees returns a reference tree, two replicas of it and the current tree
+func trees(t *testing.T) (string, []string, string) {
+	big := testutil.RandomBytes(1, 256*1024)
+
+	dir := t.TempDir()
+	ref := filepath.Join(dir, "ref")
+	testutil.WriteFile(t, filepath.Join(ref, "big.bin"), big)
+	testutil.WriteFile(t, filepath.Join(ref, "dir/sub/file.txt"), []byte("hello"))
+	testutil.WriteFile(t, filepath.Join(ref, "empty"), nil)
+	testutil.WriteFile(t, filepath.Join(ref, "touched.txt"), []byte("touched"))
+	require.NoError(t, os.Symlink("dir/sub/file.txt", filepath.Join(ref, "link")))
+
+	cur := filepath.Join(dir, "cur")
+	testutil.CopyTree(t, ref, cur)
+	replicas := []string{filepath.Join(dir, "replica1"), filepath.Join(dir, "replica2")}
+	for _, replica := range replicas {
+		testutil.CopyTree(t, ref, replica)
+	}
+
+	// change, add and delete files, turn a file into a directory, move the link
+	// and change the metadata of a file only
+	edited := append(append(append([]byte{}, big[:100000]...), []byte("inserted")...), big[100000:]...)
+	testutil.WriteFile(t, filepath.Join(cur, "big.bin"), edited)
+	testutil.WriteFile(t, filepath.Join(cur, "new/deep/new.txt"), []byte("new"))
+	require.NoError(t, os.RemoveAll(filepath.Join(cur, "dir/sub")))
+	require.NoError(t, os.Remove(filepath.Join(cur, "empty")))
+	testutil.WriteFile(t, filepath.Join(cur, "empty/inside"), []byte("inside"))
+	require.NoError(t, os.Remove(filepath.Join(cur, "link")))
+	require.NoError(t, os.Symlink("big.bin", filepath.Join(cur, "link")))
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chmod(filepath.Join(cur, "touched.txt"), 0600))
+	require.NoError(t, os.Chtimes(filepath.Join(cur, "touched.txt"), mtime, mtime))
+	require.NoError(t, os.Chmod(filepath.Join(cur, "dir"), 0750))
+
+	return ref, replicas, cur
+}
+
+func TestBatch(t *testing.T) {
+	ref, replicas, cur := trees(t)
+
+	filename := filepath.Join(t.TempDir(), "update.batch")
+	stats, err := Write(filename, ref, cur)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Patched)
+	assert.Equal(t, 2, stats.Created)
+	// dir/sub, the file replaced by a directory
+	assert.Equal(t, 2, stats.Removed)
+	assert.Less(t, stats.Literal, int64(16*1024), "only the blocks around the insertion are sent")
+
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	assert.Less(t, info.Size(), int64(20*1024))
+
+	for _, replica := range replicas {
+		applied, err := Apply(filename, replica, nil)
+		require.NoError(t, err)
+		assert.Equal(t, stats, applied)
+		assert.Equal(t, testutil.Snapshot(t, cur, true), testutil.Snapshot(t, replica, true))
+	}
+
+	// the updated replica is not the reference tree anymore
+	_, err = Apply(filename, replicas[0], nil)
+	assert.ErrorIs(t, err, ErrReferenceMismatch)
+	assert.Equal(t, testutil.Snapshot(t, cur, true), testutil.Snapshot(t, replicas[0], true))
+}
+
+func TestBatchUnchanged(t *testing.T) {
+	ref, replicas, _ := trees(t)
+
+	filename := filepath.Join(t.TempDir(), "update.batch")
+	stats, err := Write(filename, ref, replicas[0])
+	require.NoError(t, err)
+	assert.Equal(t, &Stats{}, stats)
+
+	before := testutil.Snapshot(t, replicas[1], true)
+	_, err = Apply(filename, replicas[1], nil)
+	require.NoError(t, err)
+	assert.Equal(t, before, testutil.Snapshot(t, replicas[1], true))
+}
+
+func TestBatchCorrupt(t *testing.T) {
+	ref, replicas, cur := trees(t)
+
+	filename := filepath.Join(t.TempDir(), "update.batch")
+	_, err := Write(filename, ref, cur)
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+
+	// a truncated batch changes nothing
+	require.NoError(t, ioutil.WriteFile(filename, data[:len(data)-10], 0644))
+	before := testutil.Snapshot(t, replicas[0], true)
+	_, err = Apply(filename, replicas[0], nil)
+	assert.Error(t, err)
+	assert.Equal(t, before, testutil.Snapshot(t, replicas[0], true))
+
+	// a replica differing from the reference is refused
+	require.NoError(t, ioutil.WriteFile(filename, data, 0644))
+	testutil.WriteFile(t, filepath.Join(replicas[0], "extra"), []byte("extra"))
+	before = testutil.Snapshot(t, replicas[0], true)
+	_, err = Apply(filename, replicas[0], nil)
+	assert.ErrorIs(t, err, ErrReferenceMismatch)
+	assert.Equal(t, before, testutil.Snapshot(t, replicas[0], true))
+}
+
+func TestBatchSigned(t *testing.T) {
+	ref, replicas, cur := trees(t)
+
+	filename := filepath.Join(t.TempDir(), "update.batch")
+	_, err := Write(filename, ref, cur)
+	require.NoError(t, err)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	_, err = Apply(filename, replicas[0], pub)
+	assert.ErrorIs(t, err, files.ErrUnsigned)
+
+	require.NoError(t, files.SignFile(filename, priv))
+
+	// a changed batch is refused before anything is decoded or changed
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	changed := append([]byte{}, data...)
+	changed[len(changed)-1] ^= 1
+	require.NoError(t, ioutil.WriteFile(filename, changed, 0644))
+
+	before := testutil.Snapshot(t, replicas[0], true)
+	_, err = Apply(filename, replicas[0], pub)
+	assert.ErrorIs(t, err, files.ErrBadSignature)
+	assert.Equal(t, before, testutil.Snapshot(t, replicas[0], true))
+
+	require.NoError(t, ioutil.WriteFile(filename, data, 0644))
+	_, err = Apply(filename, replicas[0], pub)
+	require.NoError(t, err)
+	assert.Equal(t, testutil.Snapshot(t, cur, true), testutil.Snapshot(t, replicas[0], true))
+}
+
+func TestCheckPath(t *testing.T) {
+	for _, p := range []string{".", "..", "../x", "/etc/passwd", "a/../../b", "a//b", "a/"} {
+		assert.Error(t, checkPath(p, OpFile), p)
+	}
+
+	assert.Error(t, checkPath("", OpRemove))
+	assert.NoError(t, checkPath("", OpMetadata))
+	assert.NoError(t, checkPath("a/b", OpFile))
+}
+
+func TestApplyThroughSymlink(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(outside, "x"), []byte("outside"))
+	before := testutil.Snapshot(t, outside, true)
+
+	stats := &Stats{}
+	require.NoError(t, apply(dir, &Op{Type: OpSymlink, Path: "a", Link: outside}, nil, stats))
+
+	// nothing is written, removed or changed through the symlink
+	patch := &delta.Patch{Ops: []*delta.Op{{Type: delta.OpLiteral, Literal: []byte("written")}}}
+	assert.Error(t, apply(dir, &Op{Type: OpFile, Path: "a/y", Mode: 0644}, patch, stats))
+	assert.Error(t, apply(dir, &Op{Type: OpRemove, Path: "a/x"}, nil, stats))
+	assert.Error(t, apply(dir, &Op{Type: OpMkdir, Path: "a/d"}, nil, stats))
+	assert.Error(t, apply(dir, &Op{Type: OpMetadata, Path: "a", Mode: os.ModeDir | 0777}, nil, stats))
+	assert.Error(t, apply(dir, &Op{Type: OpFile, Path: "a", Mode: 0644}, patch, stats))
+
+	assert.Equal(t, before, testutil.Snapshot(t, outside, true))
+}
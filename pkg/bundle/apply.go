@@ -0,0 +1,306 @@
+package bundle
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/k1ng440/rolling-hash/pkg/files"
+	"github.com/k1ng440/rolling-hash/pkg/internal/utils"
+)
+
+// journalName is the file recording an apply in progress at the root of the tree
+const journalName = ".bundle-journal"
+
+// journal lists the changes of an apply in progress and the directories it created
+type journal struct {
+	Entries []*Entry
+	Dirs    []string
+}
+
+// Apply updates the tree at dir. Every file is checked against the manifest and
+// rebuilt beside itself before the first one is replaced, and the replaced files
+// are kept until the last one is in place: on error the tree is rolled back.
+// An apply interrupted by a crash is rolled back by the next Apply or Recover.
+func (b *Bundle) Apply(dir string) error {
+	if err := Recover(dir); err != nil {
+		return err
+	}
+
+	if err := b.check(dir); err != nil {
+		return err
+	}
+
+	j := &journal{Entries: b.Manifest.Entries}
+	err := b.stage(dir, j)
+	if err == nil {
+		err = writeJournal(dir, j)
+	}
+	if err == nil {
+		err = commit(dir, j)
+	}
+
+	if err != nil {
+		if rbErr := rollback(dir, j); rbErr != nil {
+			return fmt.Errorf("%v, rollback failed: %w", err, rbErr)
+		}
+
+		os.Remove(filepath.Join(dir, journalName))
+		return err
+	}
+
+	// the update is complete once the journal is gone
+	if err := os.Remove(filepath.Join(dir, journalName)); err != nil {
+		return err
+	}
+
+	for _, entry := range j.Entries {
+		os.Remove(backupPath(dir, entry))
+	}
+
+	return nil
+}
+
+// Recover rolls back an apply interrupted in the tree at dir, if any
+func Recover(dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, journalName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	j := &journal{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(j); err != nil {
+		return fmt.Errorf("reading bundle journal: %w", err)
+	}
+
+	for _, entry := range j.Entries {
+		if _, err := utils.LocalPath(entry.Path); err != nil {
+			return fmt.Errorf("%w in bundle journal", err)
+		}
+	}
+
+	if err := rollback(dir, j); err != nil {
+		return err
+	}
+
+	return os.Remove(filepath.Join(dir, journalName))
+}
+
+// check verifies that the tree holds the old version of every file
+func (b *Bundle) check(dir string) error {
+	for _, entry := range b.Manifest.Entries {
+		target := targetPath(dir, entry)
+
+		if entry.Action == ActionAdd {
+			if _, err := os.Lstat(target); !os.IsNotExist(err) {
+				return fmt.Errorf("%s: already exists", entry.Path)
+			}
+			continue
+		}
+
+		sum, err := utils.HashFile(target)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(sum, entry.OldHash) {
+			return fmt.Errorf("%s: does not match the old version of the bundle", entry.Path)
+		}
+	}
+
+	return nil
+}
+
+// stage writes the new version of every file beside it
+func (b *Bundle) stage(dir string, j *journal) error {
+	for _, entry := range j.Entries {
+		if entry.Action == ActionRemove {
+			continue
+		}
+
+		if entry.Action == ActionAdd {
+			created, err := mkdirs(dir, filepath.Dir(targetPath(dir, entry)))
+			j.Dirs = append(j.Dirs, created...)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := b.stageFile(dir, entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Bundle) stageFile(dir string, entry *Entry) error {
+	patch, err := b.patch(entry)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(patch.TargetHash, entry.NewHash) {
+		return fmt.Errorf("%s: delta does not match the manifest", entry.Path)
+	}
+
+	// added and replaced files copy nothing from their basis
+	var basis io.ReaderAt = bytes.NewReader(nil)
+	if entry.Action == ActionPatch {
+		old, err := os.Open(targetPath(dir, entry))
+		if err != nil {
+			return err
+		}
+		defer old.Close()
+		basis = old
+	}
+
+	// a staged file left by a crash before the journal was written is overwritten
+	fi, err := os.OpenFile(stagedPath(dir, entry), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, entry.Mode)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	w := bufio.NewWriter(fi)
+	if err := delta.Apply(basis, patch, w); err != nil {
+		return fmt.Errorf("%s: %w", entry.Path, err)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	// the mode given to OpenFile is masked by the umask
+	if err := fi.Chmod(entry.Mode); err != nil {
+		return err
+	}
+
+	if err := fi.Sync(); err != nil {
+		return err
+	}
+
+	return fi.Close()
+}
+
+// commit moves the old files aside and the new ones in place
+func commit(dir string, j *journal) error {
+	for _, entry := range j.Entries {
+		target := targetPath(dir, entry)
+
+		if entry.Action != ActionAdd {
+			if err := os.Rename(target, backupPath(dir, entry)); err != nil {
+				return err
+			}
+		}
+
+		if entry.Action != ActionRemove {
+			if err := os.Rename(stagedPath(dir, entry), target); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// rollback restores the old files. The state of every entry is told by the
+// files left: a backup is the old file, a staged file was not moved in place yet.
+func rollback(dir string, j *journal) error {
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for i := len(j.Entries) - 1; i >= 0; i-- {
+		entry := j.Entries[i]
+		target := targetPath(dir, entry)
+		staged := stagedPath(dir, entry)
+
+		_, err := os.Lstat(staged)
+		committed := os.IsNotExist(err)
+
+		switch {
+		case entry.Action != ActionAdd:
+			if _, err := os.Lstat(backupPath(dir, entry)); err == nil {
+				keep(os.Rename(backupPath(dir, entry), target))
+			}
+
+		case committed:
+			keep(os.Remove(target))
+		}
+
+		if !committed {
+			keep(os.Remove(staged))
+		}
+	}
+
+	for i := len(j.Dirs) - 1; i >= 0; i-- {
+		keep(os.Remove(filepath.Join(dir, j.Dirs[i])))
+	}
+
+	return firstErr
+}
+
+// mkdirs creates the missing directories of path under dir and returns them relative to dir
+func mkdirs(dir, path string) ([]string, error) {
+	if _, err := os.Stat(path); err == nil || path == dir {
+		return nil, nil
+	}
+
+	created, err := mkdirs(dir, filepath.Dir(path))
+	if err != nil {
+		return created, err
+	}
+
+	if err := os.Mkdir(path, 0755); err != nil {
+		return created, err
+	}
+
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return created, err
+	}
+
+	return append(created, rel), nil
+}
+
+func writeJournal(dir string, j *journal) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(j); err != nil {
+		return err
+	}
+
+	return files.WriteFile(filepath.Join(dir, journalName), buf)
+}
+
+func targetPath(dir string, entry *Entry) string {
+	local, _ := utils.LocalPath(entry.Path)
+	return filepath.Join(dir, local)
+}
+
+// stagedPath is the new version of a file written before it replaces the file
+func stagedPath(dir string, entry *Entry) string {
+	return siblingPath(targetPath(dir, entry), ".bundle-new")
+}
+
+// backupPath is the old version of a file kept until the apply completes
+func backupPath(dir string, entry *Entry) string {
+	return siblingPath(targetPath(dir, entry), ".bundle-old")
+}
+
+func siblingPath(target, suffix string) string {
+	return filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+suffix)
+}
@@ -0,0 +1,386 @@
+// Package bundle packs the changes between two directory trees in a single file.
+// A bundle holds the deltas of the changed files followed by a manifest listing
+// every file to add, remove, patch or replace, and applies as a whole.
+package bundle
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/k1ng440/rolling-hash/pkg/files"
+	"github.com/k1ng440/rolling-hash/pkg/internal/utils"
+)
+
+const (
+	// bundleMagic starts the content of every bundle
+	bundleMagic = "RHBUNDL1"
+	// trailerSize is the size of the manifest length and content size ending a bundle
+	trailerSize = 16
+)
+
+var errInvalidBundle = errors.New("invalid bundle file")
+
+// Action tells how a file is updated
+type Action uint8
+
+const (
+	// ActionAdd creates a file missing from the old tree
+	ActionAdd Action = iota
+	// ActionRemove removes a file missing from the new tree
+	ActionRemove
+	// ActionPatch rebuilds a file from its old version and a delta
+	ActionPatch
+	// ActionReplace rewrites a file sharing no block with its old version
+	ActionReplace
+)
+
+var actionNames = map[Action]string{
+	ActionAdd:     "add",
+	ActionRemove:  "remove",
+	ActionPatch:   "patch",
+	ActionReplace: "replace",
+}
+
+func (a Action) String() string {
+	if name, ok := actionNames[a]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("action(%d)", uint8(a))
+}
+
+// Entry is a file changed by a bundle
+type Entry struct {
+	// Path is relative to the root of the tree, slash separated
+	Path   string
+	Action Action
+	Mode   os.FileMode
+	// OldHash and NewHash are the sha256 hashes of the file before and after
+	// the update, empty for added and removed files respectively
+	OldHash []byte
+	NewHash []byte
+	// Offset and Length locate the delta of the file in the bundle content
+	Offset int64
+	Length int64
+}
+
+// Manifest lists the changes of a bundle
+type Manifest struct {
+	Entries []*Entry
+}
+
+// Create writes a bundle updating the tree at oldDir to the tree at newDir.
+// Only regular files are compared, directories are created as needed.
+func Create(filename, oldDir, newDir string) (*Manifest, error) {
+	return CreateWithMode(filename, oldDir, newDir, files.DefaultFileMode)
+}
+
+// CreateWithMode writes a bundle like Create with the given permission
+func CreateWithMode(filename, oldDir, newDir string, mode os.FileMode) (*Manifest, error) {
+	oldFiles, err := listFiles(oldDir)
+	if err != nil {
+		return nil, err
+	}
+
+	newFiles, err := listFiles(newDir)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(oldFiles)+len(newFiles))
+	for p := range newFiles {
+		paths = append(paths, p)
+	}
+	for p := range oldFiles {
+		if _, ok := newFiles[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	manifest := &Manifest{}
+	pr, pw := io.Pipe()
+	go func() {
+		bw := bufio.NewWriter(pw)
+		err := manifest.write(&countingWriter{w: bw}, paths, oldDir, newDir, oldFiles, newFiles)
+		if err == nil {
+			err = bw.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err = files.WriteFileWithMode(filename, pr, mode)
+	// stop the writer when the file could not be written
+	pr.CloseWithError(errors.New("bundle file not written"))
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// write writes the bundle content: the magic, the deltas, the manifest and the trailer
+func (m *Manifest) write(w *countingWriter, paths []string, oldDir, newDir string, oldFiles, newFiles map[string]os.FileInfo) error {
+	if _, err := w.Write([]byte(bundleMagic)); err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		entry, patch, err := diffFile(p, oldDir, newDir, oldFiles[p], newFiles[p])
+		if err != nil {
+			return err
+		}
+
+		if entry == nil {
+			continue
+		}
+
+		if patch != nil {
+			entry.Offset = w.n
+			opts := &files.DeltaOptions{Compression: files.CompressionFlate}
+			if err := files.EncodeDelta(w, patch, opts); err != nil {
+				return err
+			}
+			entry.Length = w.n - entry.Offset
+		}
+
+		m.Entries = append(m.Entries, entry)
+	}
+
+	start := w.n
+	if err := gob.NewEncoder(w).Encode(m); err != nil {
+		return err
+	}
+
+	trailer := make([]byte, trailerSize)
+	binary.BigEndian.PutUint64(trailer, uint64(w.n-start))
+	binary.BigEndian.PutUint64(trailer[8:], uint64(w.n+trailerSize))
+	_, err := w.Write(trailer)
+	return err
+}
+
+// diffFile returns the entry and the delta of a file, a nil entry when the file is unchanged
+func diffFile(p, oldDir, newDir string, oldInfo, newInfo os.FileInfo) (*Entry, *delta.Patch, error) {
+	oldPath := filepath.Join(oldDir, filepath.FromSlash(p))
+	newPath := filepath.Join(newDir, filepath.FromSlash(p))
+
+	if newInfo == nil {
+		oldHash, err := utils.HashFile(oldPath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return &Entry{Path: p, Action: ActionRemove, Mode: oldInfo.Mode().Perm(), OldHash: oldHash}, nil, nil
+	}
+
+	entry := &Entry{Path: p, Action: ActionAdd, Mode: newInfo.Mode().Perm()}
+	var sigs []*delta.BlockSignature
+	var basis io.ReaderAt = bytes.NewReader(nil)
+	if oldInfo != nil {
+		oldHash, err := utils.HashFile(oldPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		entry.OldHash = oldHash
+
+		old, err := os.Open(oldPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer old.Close()
+
+		if sigs, err = delta.GenerateSignatures(old, delta.DefaultBlockSize); err != nil {
+			return nil, nil, err
+		}
+		basis = old
+	}
+
+	fi, err := os.Open(newPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fi.Close()
+
+	patch, err := delta.GeneratePatchWithBasis(fi, delta.DefaultBlockSize, sigs, basis)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry.NewHash = patch.TargetHash
+
+	if oldInfo != nil {
+		if bytes.Equal(entry.OldHash, entry.NewHash) && oldInfo.Mode().Perm() == entry.Mode {
+			return nil, nil, nil
+		}
+
+		entry.Action = ActionReplace
+		for _, op := range patch.Ops {
+			if op.Type == delta.OpCopy {
+				entry.Action = ActionPatch
+				break
+			}
+		}
+	}
+
+	// added and replaced files are rebuilt from nothing
+	if entry.Action != ActionPatch {
+		patch.BasisHash = nil
+	}
+
+	return entry, patch, nil
+}
+
+// listFiles returns the regular files of the tree at root by slash separated path
+func listFiles(root string) (map[string]os.FileInfo, error) {
+	result := make(map[string]os.FileInfo)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		result[filepath.ToSlash(rel)] = info
+		return nil
+	})
+
+	return result, err
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Bundle is an open bundle file
+type Bundle struct {
+	r io.ReaderAt
+	// f is the bundle file, nil when the bundle was read into memory
+	f *os.File
+	// base is the offset of the bundle content, after a signature if any
+	base     int64
+	Manifest *Manifest
+}
+
+// Open opens a bundle file. When trusted is set, bundles not signed with it
+// are refused, see files.SignFile. Signed bundles are read into memory once
+// and verified, so the file can not change between the check and the apply.
+func Open(filename string, trusted ed25519.PublicKey) (*Bundle, error) {
+	if trusted != nil {
+		content, err := files.ReadSigned(filename, trusted)
+		if err != nil {
+			return nil, err
+		}
+
+		return readBundle(bytes.NewReader(content), int64(len(content)))
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	b, err := readBundle(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	b.f = f
+	return b, nil
+}
+
+func readBundle(r io.ReaderAt, size int64) (*Bundle, error) {
+	trailer := make([]byte, trailerSize)
+	if size < int64(len(bundleMagic)+trailerSize) {
+		return nil, errInvalidBundle
+	}
+
+	if _, err := r.ReadAt(trailer, size-trailerSize); err != nil {
+		return nil, err
+	}
+
+	// the content is located from the end, a signature may precede it
+	manifestSize := int64(binary.BigEndian.Uint64(trailer))
+	contentSize := int64(binary.BigEndian.Uint64(trailer[8:]))
+	if contentSize > size || manifestSize > contentSize-int64(len(bundleMagic)+trailerSize) {
+		return nil, errInvalidBundle
+	}
+
+	b := &Bundle{
+		r:        r,
+		base:     size - contentSize,
+		Manifest: &Manifest{},
+	}
+
+	magic := make([]byte, len(bundleMagic))
+	if _, err := r.ReadAt(magic, b.base); err != nil || string(magic) != bundleMagic {
+		return nil, errInvalidBundle
+	}
+
+	manifest := io.NewSectionReader(r, size-trailerSize-manifestSize, manifestSize)
+	if err := gob.NewDecoder(manifest).Decode(b.Manifest); err != nil {
+		return nil, fmt.Errorf("reading bundle manifest: %w", err)
+	}
+
+	for _, entry := range b.Manifest.Entries {
+		if _, err := utils.LocalPath(entry.Path); err != nil {
+			return nil, fmt.Errorf("%w in bundle", err)
+		}
+
+		if entry.Offset < 0 || entry.Length < 0 || entry.Offset+entry.Length > contentSize {
+			return nil, errInvalidBundle
+		}
+	}
+
+	return b, nil
+}
+
+// Close closes the bundle file
+func (b *Bundle) Close() error {
+	if b.f == nil {
+		return nil
+	}
+
+	return b.f.Close()
+}
+
+// patch reads the delta of an entry
+func (b *Bundle) patch(entry *Entry) (*delta.Patch, error) {
+	r := io.NewSectionReader(b.r, b.base+entry.Offset, entry.Length)
+	_, patch, err := files.DecodeDelta(r, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", entry.Path, err)
+	}
+
+	return patch, nil
+}
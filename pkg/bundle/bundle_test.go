@@ -0,0 +1,240 @@
+package bundle
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/files"
+	"github.com/k1ng440/rolling-hash/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readTree(t *testing.T, root string) map[string][]byte {
+	tree := make(map[string][]byte)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		require.NoError(t, err)
+		if info.Mode().IsRegular() {
+			rel, err := filepath.Rel(root, path)
+			require.NoError(t, err)
+
+			data, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			tree[filepath.ToSlash(rel)] = data
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return tree
+}
+
+// trees returns an old and a new tree with a file of every action and an unchanged one
+func trees() (map[string][]byte, map[string][]byte) {
+	patched := testutil.RandomBytes(1, 64*1024)
+	unchanged := testutil.RandomBytes(2, 10000)
+
+	oldTree := map[string][]byte{
+		"patched.bin":       patched,
+		"unchanged.bin":     unchanged,
+		"removed/gone.txt":  []byte("removed"),
+		"replaced/data.bin": testutil.RandomBytes(3, 5000),
+	}
+
+	edited := append(append(append([]byte{}, patched[:30000]...), []byte("inserted")...), patched[30000:]...)
+	newTree := map[string][]byte{
+		"patched.bin":        edited,
+		"unchanged.bin":      unchanged,
+		"replaced/data.bin":  testutil.RandomBytes(4, 6000),
+		"added/deep/new.txt": []byte("added"),
+	}
+
+	return oldTree, newTree
+}
+
+func createBundle(t *testing.T, oldTree, newTree map[string][]byte) (string, string, *Manifest) {
+	dir := t.TempDir()
+	oldDir := filepath.Join(dir, "old")
+	newDir := filepath.Join(dir, "new")
+	testutil.WriteTree(t, oldDir, oldTree)
+	testutil.WriteTree(t, newDir, newTree)
+
+	filename := filepath.Join(dir, "update.bundle")
+	manifest, err := Create(filename, oldDir, newDir)
+	require.NoError(t, err)
+
+	return oldDir, filename, manifest
+}
+
+func TestBundle(t *testing.T) {
+	oldTree, newTree := trees()
+	oldDir, filename, manifest := createBundle(t, oldTree, newTree)
+
+	actions := make(map[string]Action)
+	for _, entry := range manifest.Entries {
+		actions[entry.Path] = entry.Action
+	}
+	assert.Equal(t, map[string]Action{
+		"added/deep/new.txt": ActionAdd,
+		"patched.bin":        ActionPatch,
+		"removed/gone.txt":   ActionRemove,
+		"replaced/data.bin":  ActionReplace,
+	}, actions)
+
+	// the patched file only carries the inserted bytes
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	assert.Less(t, info.Size(), int64(20*1024))
+
+	b, err := Open(filename, nil)
+	require.NoError(t, err)
+	defer b.Close()
+	assert.Equal(t, manifest, b.Manifest)
+
+	require.NoError(t, b.Apply(oldDir))
+	assert.Equal(t, newTree, readTree(t, oldDir))
+
+	// applying twice fails, the tree is not the old version anymore
+	assert.Error(t, b.Apply(oldDir))
+	assert.Equal(t, newTree, readTree(t, oldDir))
+}
+
+func TestBundleMode(t *testing.T) {
+	dir := t.TempDir()
+	oldDir := filepath.Join(dir, "old")
+	newDir := filepath.Join(dir, "new")
+	tree := map[string][]byte{"run.sh": []byte("#!/bin/sh\n")}
+	testutil.WriteTree(t, oldDir, tree)
+	testutil.WriteTree(t, newDir, tree)
+	require.NoError(t, os.Chmod(filepath.Join(newDir, "run.sh"), 0755))
+
+	filename := filepath.Join(dir, "update.bundle")
+	manifest, err := Create(filename, oldDir, newDir)
+	require.NoError(t, err)
+	require.Len(t, manifest.Entries, 1)
+	assert.Equal(t, ActionPatch, manifest.Entries[0].Action)
+
+	b, err := Open(filename, nil)
+	require.NoError(t, err)
+	defer b.Close()
+	require.NoError(t, b.Apply(oldDir))
+
+	info, err := os.Stat(filepath.Join(oldDir, "run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+}
+
+func TestBundleMismatch(t *testing.T) {
+	oldTree, newTree := trees()
+	oldDir, filename, _ := createBundle(t, oldTree, newTree)
+
+	changed := map[string][]byte{"removed/gone.txt": []byte("changed")}
+	testutil.WriteTree(t, oldDir, changed)
+
+	b, err := Open(filename, nil)
+	require.NoError(t, err)
+	defer b.Close()
+
+	assert.Error(t, b.Apply(oldDir))
+
+	expected := readTree(t, oldDir)
+	assert.Equal(t, []byte("changed"), expected["removed/gone.txt"])
+	expected["removed/gone.txt"] = oldTree["removed/gone.txt"]
+	assert.Equal(t, oldTree, expected)
+}
+
+func TestBundleRollback(t *testing.T) {
+	oldTree, newTree := trees()
+	oldDir, filename, manifest := createBundle(t, oldTree, newTree)
+
+	// the delta of the last file is corrupt, the files staged before are removed
+	last := manifest.Entries[len(manifest.Entries)-1]
+	require.Equal(t, ActionReplace, last.Action)
+
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	corrupt := append([]byte{}, data...)
+	corrupt[last.Offset+last.Length-5] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(filename, corrupt, 0644))
+
+	b, err := Open(filename, nil)
+	require.NoError(t, err)
+	assert.Error(t, b.Apply(oldDir))
+	b.Close()
+
+	assert.Equal(t, oldTree, readTree(t, oldDir))
+	_, err = os.Stat(filepath.Join(oldDir, "added"))
+	assert.True(t, os.IsNotExist(err), "created directories are removed")
+
+	require.NoError(t, ioutil.WriteFile(filename, data, 0644))
+	b, err = Open(filename, nil)
+	require.NoError(t, err)
+	defer b.Close()
+
+	require.NoError(t, b.Apply(oldDir))
+	assert.Equal(t, newTree, readTree(t, oldDir))
+}
+
+func TestBundleRecover(t *testing.T) {
+	oldTree, newTree := trees()
+	oldDir, filename, _ := createBundle(t, oldTree, newTree)
+
+	b, err := Open(filename, nil)
+	require.NoError(t, err)
+	defer b.Close()
+
+	// interrupt an apply after half of the files were moved in place
+	j := &journal{Entries: b.Manifest.Entries}
+	require.NoError(t, b.check(oldDir))
+	require.NoError(t, b.stage(oldDir, j))
+	require.NoError(t, writeJournal(oldDir, j))
+	require.NoError(t, commit(oldDir, &journal{Entries: j.Entries[:2]}))
+
+	require.NoError(t, Recover(oldDir))
+	assert.Equal(t, oldTree, readTree(t, oldDir))
+
+	// nothing is left to recover
+	require.NoError(t, Recover(oldDir))
+
+	names, err := ioutil.ReadDir(oldDir)
+	require.NoError(t, err)
+	found := make([]string, 0)
+	for _, name := range names {
+		found = append(found, name.Name())
+	}
+	sort.Strings(found)
+	assert.Equal(t, []string{"patched.bin", "removed", "replaced", "unchanged.bin"}, found)
+}
+
+func TestBundleSigned(t *testing.T) {
+	oldTree, newTree := trees()
+	oldDir, filename, _ := createBundle(t, oldTree, newTree)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	_, err = Open(filename, pub)
+	assert.ErrorIs(t, err, files.ErrUnsigned)
+
+	require.NoError(t, files.SignFile(filename, priv))
+
+	b, err := Open(filename, pub)
+	require.NoError(t, err)
+	defer b.Close()
+
+	// the verified bundle is applied even when the file changes after Open
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filename, make([]byte, len(data)), 0644))
+
+	require.NoError(t, b.Apply(oldDir))
+	assert.Equal(t, newTree, readTree(t, oldDir))
+
+	data[len(data)-1] ^= 1
+	require.NoError(t, ioutil.WriteFile(filename, data, 0644))
+	_, err = Open(filename, pub)
+	assert.ErrorIs(t, err, files.ErrBadSignature)
+}
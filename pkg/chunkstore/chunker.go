@@ -0,0 +1,152 @@
+package chunkstore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/k1ng440/rolling-hash/pkg/rollsum"
+)
+
+const (
+	// DefaultMinChunkSize is the smallest chunk cut by ContentChunker
+	DefaultMinChunkSize = 2 * 1024
+	// DefaultAvgChunkSize is the average chunk size of ContentChunker, a power of two
+	DefaultAvgChunkSize = 8 * 1024
+	// DefaultMaxChunkSize is the largest chunk cut by ContentChunker
+	DefaultMaxChunkSize = 64 * 1024
+)
+
+// contentWindow is the number of bytes hashed to find chunk boundaries
+const contentWindow = 64
+
+// fixedBatch is the number of blocks signed at once by FixedChunker
+const fixedBatch = 64
+
+// Chunker splits a stream into chunks
+type Chunker interface {
+	// Split calls emit with the chunks of r in order, the chunk is only valid during the call
+	Split(r io.Reader, emit func(chunk []byte) error) error
+}
+
+// FixedChunker cuts blocks of the same size, as GenerateSignatures does
+type FixedChunker struct {
+	BlockSize int
+}
+
+// Split implements Chunker
+func (c *FixedChunker) Split(r io.Reader, emit func(chunk []byte) error) error {
+	return c.Signatures(r, func(sig *delta.BlockSignature) error {
+		return emit(sig.BlockData)
+	})
+}
+
+// Signatures calls emit with the signature of every block of r in order, indexed
+// from the start of r as GenerateSignatures does. The block data is only valid
+// during the call.
+func (c *FixedChunker) Signatures(r io.Reader, emit func(sig *delta.BlockSignature) error) error {
+	if c.BlockSize <= 0 {
+		return errors.New("blockSize must be greater than 0")
+	}
+
+	buf := make([]byte, c.BlockSize*fixedBatch)
+	index := 0
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		sigs, sigErr := delta.GenerateSignatures(bytes.NewReader(buf[:n]), c.BlockSize)
+		if sigErr != nil {
+			return sigErr
+		}
+
+		for _, sig := range sigs {
+			// GenerateSignatures counts from the start of the batch
+			sig.Index = index
+			index++
+
+			if err := emit(sig); err != nil {
+				return err
+			}
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			return nil
+		}
+	}
+}
+
+// ContentChunker cuts chunks where the rolling checksum of the last bytes matches a
+// pattern, so an insertion only changes the chunks around it
+type ContentChunker struct {
+	MinSize int
+	// AvgSize must be a power of two
+	AvgSize int
+	MaxSize int
+}
+
+// NewContentChunker returns a content defined chunker with the default sizes
+func NewContentChunker() *ContentChunker {
+	return &ContentChunker{
+		MinSize: DefaultMinChunkSize,
+		AvgSize: DefaultAvgChunkSize,
+		MaxSize: DefaultMaxChunkSize,
+	}
+}
+
+// Split implements Chunker
+func (c *ContentChunker) Split(r io.Reader, emit func(chunk []byte) error) error {
+	if c.MinSize < contentWindow || c.AvgSize&(c.AvgSize-1) != 0 || c.MaxSize < c.MinSize {
+		return errors.New("invalid chunk sizes")
+	}
+
+	mask := uint32(c.AvgSize - 1)
+	roll := rollsum.New(contentWindow)
+	chunk := make([]byte, 0, c.MaxSize)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			chunk = append(chunk, b)
+			if roll.Size() < contentWindow {
+				roll.In(b)
+			} else {
+				roll.Rotate(b)
+			}
+
+			if len(chunk) < c.MinSize {
+				continue
+			}
+
+			if roll.Sum32()&mask == mask || len(chunk) == c.MaxSize {
+				if err := emit(chunk); err != nil {
+					return err
+				}
+
+				chunk = chunk[:0]
+				roll.Reset()
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(chunk) > 0 {
+		return emit(chunk)
+	}
+
+	return nil
+}
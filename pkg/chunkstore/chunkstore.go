@@ -0,0 +1,416 @@
+// Package chunkstore stores every unique chunk of data once, keyed by its strong hash.
+// Chunks are appended to pack files on the local filesystem and located through
+// an index, which also counts the references to every chunk.
+package chunkstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/k1ng440/rolling-hash/pkg/files"
+)
+
+// DefaultPackSize is the size from which a pack file is closed and a new one started
+const DefaultPackSize = 16 * 1024 * 1024
+
+const (
+	indexFile = "index"
+	packsDir  = "packs"
+)
+
+// ErrNotFound is returned for chunks not in the store
+var ErrNotFound = errors.New("chunk not found")
+
+// ID is the sha256 hash of a chunk
+type ID [sha256.Size]byte
+
+// Sum returns the ID of a chunk
+func Sum(chunk []byte) ID {
+	return sha256.Sum256(chunk)
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// ParseID parses the hex encoded ID of a chunk
+func ParseID(s string) (ID, error) {
+	var id ID
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(id) {
+		return id, fmt.Errorf("invalid chunk id %q", s)
+	}
+
+	copy(id[:], b)
+	return id, nil
+}
+
+// location is where a chunk is stored, along with its reference count
+type location struct {
+	Pack   int
+	Offset int64
+	Size   int
+	Refs   int
+}
+
+// index is persisted to the index file of the store
+type index struct {
+	Chunks   map[ID]*location
+	NextPack int
+	// Check is derived from the secret of encrypted stores, nil otherwise
+	Check []byte
+}
+
+// Store is a content addressable chunk store in a local directory.
+// It is safe for concurrent use.
+type Store struct {
+	dir string
+	// PackSize is the size from which a pack file is closed and a new one started
+	PackSize int64
+
+	mu       sync.Mutex
+	cipher   *Cipher
+	index    *index
+	pack     *os.File
+	packID   int
+	packSize int64
+
+	// packs is held for reading while a chunk is read from its pack and for
+	// writing while packs are removed, always taken with mu held
+	packs sync.RWMutex
+}
+
+// Open opens the store in dir, creating it when needed
+func Open(dir string) (*Store, error) {
+	return open(dir, nil)
+}
+
+// OpenEncrypted opens the store in dir like Open, with every chunk encrypted
+// by the convergent encryption of Cipher
+func OpenEncrypted(dir string, secret []byte) (*Store, error) {
+	c, err := NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(dir, c)
+}
+
+func open(dir string, c *Cipher) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, packsDir), 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		dir:      dir,
+		PackSize: DefaultPackSize,
+		cipher:   c,
+		index:    &index{Chunks: make(map[ID]*location)},
+	}
+
+	fi, err := os.Open(filepath.Join(dir, indexFile))
+	if os.IsNotExist(err) {
+		if c != nil {
+			s.index.Check = c.check
+		}
+		if err := s.skipPacks(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	if err := gob.NewDecoder(fi).Decode(s.index); err != nil {
+		return nil, fmt.Errorf("reading chunk index: %w", err)
+	}
+
+	if s.index.Chunks == nil {
+		s.index.Chunks = make(map[ID]*location)
+	}
+
+	switch {
+	case c == nil && s.index.Check != nil:
+		return nil, errors.New("chunk store is encrypted")
+	case c != nil && s.index.Check == nil:
+		return nil, errors.New("chunk store is not encrypted")
+	case c != nil && !hmac.Equal(c.check, s.index.Check):
+		return nil, errors.New("wrong secret for the chunk store")
+	}
+
+	if err := s.skipPacks(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// skipPacks moves NextPack past the pack files on disk. The index is only
+// written by Flush, so packs started after the last flush of a store that
+// was not closed are not counted in it.
+func (s *Store) skipPacks() error {
+	entries, err := os.ReadDir(filepath.Join(s.dir, packsDir))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		var pack int
+		if _, err := fmt.Sscanf(entry.Name(), "%d.pack", &pack); err != nil {
+			continue
+		}
+
+		if pack >= s.index.NextPack {
+			s.index.NextPack = pack + 1
+		}
+	}
+
+	return nil
+}
+
+// ID returns the ID of a chunk in this store, keyed with the secret when encrypted
+func (s *Store) ID(chunk []byte) ID {
+	if s.cipher != nil {
+		return s.cipher.ID(chunk)
+	}
+
+	return Sum(chunk)
+}
+
+// Put stores the chunk unless it is stored already and adds a reference to it
+func (s *Store) Put(chunk []byte) (ID, error) {
+	id := s.ID(chunk)
+
+	data := chunk
+	if s.cipher != nil {
+		// sealed before locking, it is the expensive part
+		var err error
+		if data, err = s.cipher.Seal(chunk); err != nil {
+			return id, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if loc, ok := s.index.Chunks[id]; ok {
+		loc.Refs++
+		return id, nil
+	}
+
+	loc, err := s.append(data)
+	if err != nil {
+		return id, err
+	}
+
+	loc.Refs = 1
+	s.index.Chunks[id] = loc
+	return id, nil
+}
+
+// Get returns the content of a chunk, checked against its ID and decrypted when sealed
+func (s *Store) Get(id ID) ([]byte, error) {
+	s.mu.Lock()
+	loc, ok := s.index.Chunks[id]
+	if !ok {
+		s.mu.Unlock()
+		return nil, ErrNotFound
+	}
+
+	// copied, a sweep may move the chunk meanwhile but keeps its pack until read
+	l := *loc
+	s.packs.RLock()
+	defer s.packs.RUnlock()
+	s.mu.Unlock()
+
+	return s.read(id, &l)
+}
+
+// Has reports whether the chunk is stored
+func (s *Store) Has(id ID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.index.Chunks[id]
+	return ok
+}
+
+// Refs returns the number of references to the chunk
+func (s *Store) Refs(id ID) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if loc, ok := s.index.Chunks[id]; ok {
+		return loc.Refs
+	}
+
+	return 0
+}
+
+// Ref adds a reference to a stored chunk
+func (s *Store) Ref(id ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loc, ok := s.index.Chunks[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	loc.Refs++
+	return nil
+}
+
+// Release drops a reference to the chunk, chunks without references are
+// removed by the next Collect
+func (s *Store) Release(id ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loc, ok := s.index.Chunks[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	if loc.Refs > 0 {
+		loc.Refs--
+	}
+
+	return nil
+}
+
+// Flush syncs the current pack file and writes the index
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flush()
+}
+
+// Close flushes the store and closes the current pack file
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	return s.closePack()
+}
+
+func (s *Store) flush() error {
+	if s.pack != nil {
+		if err := s.pack.Sync(); err != nil {
+			return err
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(s.index); err != nil {
+		return err
+	}
+
+	return files.WriteFile(filepath.Join(s.dir, indexFile), buf)
+}
+
+// append writes the chunk to the current pack file, starting a new one when full
+func (s *Store) append(chunk []byte) (*location, error) {
+	if s.pack != nil && s.packSize >= s.PackSize {
+		if err := s.closePack(); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.pack == nil {
+		s.packID = s.index.NextPack
+		s.index.NextPack++
+
+		fi, err := os.OpenFile(s.packPath(s.packID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, files.DefaultFileMode)
+		if err != nil {
+			return nil, err
+		}
+
+		s.pack = fi
+		s.packSize = 0
+	}
+
+	if _, err := s.pack.Write(chunk); err != nil {
+		return nil, err
+	}
+
+	loc := &location{
+		Pack:   s.packID,
+		Offset: s.packSize,
+		Size:   len(chunk),
+	}
+	s.packSize += int64(len(chunk))
+
+	return loc, nil
+}
+
+// closePack syncs and closes the current pack file, the next chunk starts a new one
+func (s *Store) closePack() error {
+	if s.pack == nil {
+		return nil
+	}
+
+	err := s.pack.Sync()
+	if cerr := s.pack.Close(); err == nil {
+		err = cerr
+	}
+
+	s.pack = nil
+	return err
+}
+
+// read reads a chunk from its pack file and checks it against its ID
+func (s *Store) read(id ID, loc *location) ([]byte, error) {
+	chunk, err := s.readRecord(loc)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cipher != nil {
+		if chunk, err = s.cipher.Open(chunk); err != nil {
+			return nil, fmt.Errorf("chunk %s: %w", id, err)
+		}
+	}
+
+	if s.ID(chunk) != id {
+		return nil, fmt.Errorf("chunk %s is corrupt", id)
+	}
+
+	return chunk, nil
+}
+
+// readRecord reads the bytes stored for a chunk, sealed when the store is encrypted
+func (s *Store) readRecord(loc *location) ([]byte, error) {
+	fi, err := os.Open(s.packPath(loc.Pack))
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	record := make([]byte, loc.Size)
+	if _, err := fi.ReadAt(record, loc.Offset); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (s *Store) packPath(pack int) string {
+	return filepath.Join(s.dir, packsDir, fmt.Sprintf("%08d.pack", pack))
+}
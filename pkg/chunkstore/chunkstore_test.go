@@ -0,0 +1,199 @@
+package chunkstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	require.NoError(t, err)
+
+	a, err := s.Put([]byte("first chunk"))
+	require.NoError(t, err)
+	b, err := s.Put([]byte("second chunk"))
+	require.NoError(t, err)
+
+	again, err := s.Put([]byte("first chunk"))
+	require.NoError(t, err)
+	assert.Equal(t, a, again)
+	assert.Equal(t, 2, s.Refs(a))
+	assert.Equal(t, 1, s.Refs(b))
+	require.NoError(t, s.Close())
+
+	// the chunks are found again once reopened
+	s, err = Open(dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	chunk, err := s.Get(b)
+	require.NoError(t, err)
+	assert.Equal(t, "second chunk", string(chunk))
+	assert.Equal(t, 2, s.Refs(a))
+
+	_, err = s.Get(Sum([]byte("missing")))
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	id, err := ParseID(a.String())
+	require.NoError(t, err)
+	assert.Equal(t, a, id)
+}
+
+func TestStoreReopenWithoutFlush(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	require.NoError(t, err)
+
+	// crash after writing a chunk to a new pack, before the index is written
+	_, err = s.Put([]byte("lost chunk"))
+	require.NoError(t, err)
+	require.NoError(t, s.closePack())
+
+	s, err = Open(dir)
+	require.NoError(t, err)
+
+	id, err := s.Put([]byte("first chunk"))
+	require.NoError(t, err)
+	require.NoError(t, s.Flush())
+	require.NoError(t, s.closePack())
+
+	// crash again after the flush, with more chunks in a new pack
+	s, err = Open(dir)
+	require.NoError(t, err)
+	s.PackSize = 1
+	for _, chunk := range []string{"second chunk", "third chunk"} {
+		_, err = s.Put([]byte(chunk))
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.closePack())
+
+	s, err = Open(dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.Put([]byte("fourth chunk"))
+	require.NoError(t, err)
+
+	chunk, err := s.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, "first chunk", string(chunk))
+}
+
+func TestStoreCorruptChunk(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	require.NoError(t, err)
+
+	id, err := s.Put([]byte("some chunk"))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	require.NoError(t, ioutil.WriteFile(s.packPath(0), []byte("some chunK"), 0644))
+	_, err = s.Get(id)
+	assert.Error(t, err)
+}
+
+func TestCollect(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	require.NoError(t, err)
+	s.PackSize = 16
+
+	ids := make([]ID, 0)
+	for _, chunk := range []string{"chunk one", "chunk two", "chunk three", "chunk four"} {
+		id, err := s.Put([]byte(chunk))
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	require.NoError(t, s.Release(ids[1]))
+	require.NoError(t, s.Release(ids[2]))
+
+	removed, err := s.Collect()
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	assert.False(t, s.Has(ids[1]))
+
+	for i, chunk := range map[int]string{0: "chunk one", 3: "chunk four"} {
+		res, err := s.Get(ids[i])
+		require.NoError(t, err)
+		assert.Equal(t, chunk, string(res))
+	}
+	require.NoError(t, s.Close())
+
+	// the rewritten packs only hold the remaining chunks
+	packs, err := filepath.Glob(filepath.Join(dir, packsDir, "*.pack"))
+	require.NoError(t, err)
+
+	size := 0
+	for _, pack := range packs {
+		data, err := ioutil.ReadFile(pack)
+		require.NoError(t, err)
+		size += len(data)
+	}
+	assert.Equal(t, len("chunk one")+len("chunk four"), size)
+}
+
+func TestGC(t *testing.T) {
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+	defer s.Close()
+
+	a, _ := s.Put([]byte("chunk a"))
+	b, _ := s.Put([]byte("chunk b"))
+	c, _ := s.Put([]byte("chunk c"))
+
+	// the reference counts are rebuilt from the roots
+	removed, err := s.GC([][]ID{{a, b}, {b}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	assert.Equal(t, 1, s.Refs(a))
+	assert.Equal(t, 2, s.Refs(b))
+	assert.False(t, s.Has(c))
+}
+
+func TestGetDuringGC(t *testing.T) {
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+	defer s.Close()
+
+	live, err := s.Put([]byte("live chunk"))
+	require.NoError(t, err)
+
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			if _, err := s.Get(live); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	// every collection moves the live chunk out of the pack it removes
+	for i := 0; i < 200; i++ {
+		garbage, err := s.Put([]byte(fmt.Sprintf("garbage %d", i)))
+		require.NoError(t, err)
+		_, err = s.GC([][]ID{{live}})
+		require.NoError(t, err)
+		require.False(t, s.Has(garbage))
+	}
+	close(stop)
+
+	assert.NoError(t, <-errs)
+}
@@ -0,0 +1,159 @@
+package chunkstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+// SecretSize is the minimum size of a repository secret
+const SecretSize = 32
+
+var errSealed = errors.New("sealed data is corrupt or was sealed with another secret")
+
+// Cipher implements the convergent encryption of chunks. The key of a chunk is
+// derived from its strong hash keyed with the repository secret, so the same
+// chunk always gets the same key within a repository and still deduplicates,
+// while the sealed chunk can not be matched against a known chunk without the
+// secret. Chunk IDs are keyed with the secret too, for the same reason.
+type Cipher struct {
+	idKey []byte
+	// chunkKey derives the key of every chunk from its strong hash
+	chunkKey []byte
+	// wrap seals the chunk keys stored beside the chunks
+	wrap cipher.AEAD
+	// data seals data that is not deduplicated
+	data  cipher.AEAD
+	check []byte
+}
+
+// NewCipher derives the keys of the cipher from the repository secret
+func NewCipher(secret []byte) (*Cipher, error) {
+	if len(secret) < SecretSize {
+		return nil, errors.New("secret must be at least 32 bytes")
+	}
+
+	wrap, err := newAEAD(derive(secret, "chunkstore key wrapping"))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := newAEAD(derive(secret, "chunkstore data"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{
+		idKey:    derive(secret, "chunkstore chunk id"),
+		chunkKey: derive(secret, "chunkstore chunk key"),
+		wrap:     wrap,
+		data:     data,
+		check:    derive(secret, "chunkstore check"),
+	}, nil
+}
+
+// ID returns the keyed ID of a chunk
+func (c *Cipher) ID(chunk []byte) ID {
+	strong := sha256.Sum256(chunk)
+
+	var id ID
+	copy(id[:], derive(c.idKey, string(strong[:])))
+	return id
+}
+
+// Seal encrypts a chunk with the key derived from its strong hash and the secret.
+// The result holds the chunk key sealed with the secret followed by the sealed chunk.
+func (c *Cipher) Seal(chunk []byte) ([]byte, error) {
+	strong := sha256.Sum256(chunk)
+	key := derive(c.chunkKey, string(strong[:]))
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := sealRandom(c.wrap, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// every key seals a single plaintext, a fixed nonce is safe
+	return aead.Seal(sealed, make([]byte, aead.NonceSize()), chunk, nil), nil
+}
+
+// Open decrypts a chunk sealed by Seal
+func (c *Cipher) Open(sealed []byte) ([]byte, error) {
+	wrapped := c.wrap.NonceSize() + sha256.Size + c.wrap.Overhead()
+	if len(sealed) < wrapped {
+		return nil, errSealed
+	}
+
+	key, err := openRandom(c.wrap, sealed[:wrapped])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	chunk, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed[wrapped:], nil)
+	if err != nil {
+		return nil, errSealed
+	}
+
+	return chunk, nil
+}
+
+// SealData encrypts data that is not deduplicated, such as manifests, with a random nonce
+func (c *Cipher) SealData(data []byte) ([]byte, error) {
+	return sealRandom(c.data, data)
+}
+
+// OpenData decrypts data sealed by SealData
+func (c *Cipher) OpenData(sealed []byte) ([]byte, error) {
+	return openRandom(c.data, sealed)
+}
+
+// derive returns the HMAC-SHA256 of label keyed with key
+func derive(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealRandom seals data with a random nonce written before the sealed data
+func sealRandom(aead cipher.AEAD, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func openRandom(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errSealed
+	}
+
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errSealed
+	}
+
+	return data, nil
+}
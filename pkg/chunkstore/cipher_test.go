@@ -0,0 +1,114 @@
+package chunkstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	secret      = bytes.Repeat([]byte{1}, SecretSize)
+	otherSecret = bytes.Repeat([]byte{2}, SecretSize)
+)
+
+func TestCipher(t *testing.T) {
+	c, err := NewCipher(secret)
+	require.NoError(t, err)
+
+	chunk := []byte("The quick brown fox jumps over the lazy dog")
+	sealed, err := c.Seal(chunk)
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), "quick")
+
+	res, err := c.Open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, chunk, res)
+
+	// the ID depends on the secret, not only on the content
+	other, err := NewCipher(otherSecret)
+	require.NoError(t, err)
+	assert.Equal(t, c.ID(chunk), c.ID(append([]byte{}, chunk...)))
+	assert.NotEqual(t, c.ID(chunk), other.ID(chunk))
+	assert.NotEqual(t, Sum(chunk), c.ID(chunk))
+
+	_, err = other.Open(sealed)
+	assert.Error(t, err)
+
+	// the sealed chunk, after the wrapped key, only deduplicates under the same secret
+	wrapped := c.wrap.NonceSize() + sha256.Size + c.wrap.Overhead()
+	again, err := c.Seal(chunk)
+	require.NoError(t, err)
+	assert.Equal(t, sealed[wrapped:], again[wrapped:])
+
+	otherSealed, err := other.Seal(chunk)
+	require.NoError(t, err)
+	assert.NotEqual(t, sealed[wrapped:], otherSealed[wrapped:])
+
+	sealed[len(sealed)-1] ^= 0xff
+	_, err = c.Open(sealed)
+	assert.Error(t, err)
+
+	_, err = NewCipher([]byte("short"))
+	assert.Error(t, err)
+}
+
+func TestCipherData(t *testing.T) {
+	c, err := NewCipher(secret)
+	require.NoError(t, err)
+
+	sealed, err := c.SealData([]byte("manifest"))
+	require.NoError(t, err)
+
+	res, err := c.OpenData(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "manifest", string(res))
+
+	_, err = c.Open(sealed)
+	assert.Error(t, err)
+}
+
+func TestEncryptedStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenEncrypted(dir, secret)
+	require.NoError(t, err)
+
+	chunk := []byte("The quick brown fox jumps over the lazy dog")
+	id, err := s.Put(chunk)
+	require.NoError(t, err)
+
+	// equal chunks still deduplicate
+	again, err := s.Put(append([]byte{}, chunk...))
+	require.NoError(t, err)
+	assert.Equal(t, id, again)
+	assert.Equal(t, 2, s.Refs(id))
+
+	other, err := s.Put([]byte("another chunk"))
+	require.NoError(t, err)
+	require.NoError(t, s.Release(other))
+	_, err = s.Collect()
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	pack, err := ioutil.ReadFile(filepath.Join(dir, packsDir, "00000001.pack"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(pack), "quick")
+
+	_, err = Open(dir)
+	assert.Error(t, err)
+
+	_, err = OpenEncrypted(dir, otherSecret)
+	assert.Error(t, err)
+
+	s, err = OpenEncrypted(dir, secret)
+	require.NoError(t, err)
+	defer s.Close()
+
+	res, err := s.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, chunk, res)
+}
@@ -0,0 +1,104 @@
+package chunkstore
+
+import (
+	"io"
+)
+
+// DedupWriter splits the stream written to it into chunks and stores the chunks
+// not stored already. The list of chunks rebuilding the stream is available
+// once the writer is closed.
+type DedupWriter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	ids  []ID
+	size int64
+	err  error
+}
+
+// NewDedupWriter returns a writer storing chunks cut by chunker in s
+func NewDedupWriter(s *Store, chunker Chunker) *DedupWriter {
+	pr, pw := io.Pipe()
+	w := &DedupWriter{
+		pw:   pw,
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.done)
+
+		w.err = chunker.Split(pr, func(chunk []byte) error {
+			id, err := s.Put(chunk)
+			if err != nil {
+				return err
+			}
+
+			w.ids = append(w.ids, id)
+			w.size += int64(len(chunk))
+			return nil
+		})
+
+		// unblock writes when splitting stops early
+		pr.CloseWithError(w.err)
+	}()
+
+	return w
+}
+
+// Write implements io.Writer
+func (w *DedupWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close waits for the last chunks to be stored
+func (w *DedupWriter) Close() error {
+	w.pw.Close()
+	<-w.done
+
+	return w.err
+}
+
+// IDs returns the chunks of the stream in order, valid once the writer is closed
+func (w *DedupWriter) IDs() []ID {
+	return w.ids
+}
+
+// Size returns the number of bytes written, valid once the writer is closed
+func (w *DedupWriter) Size() int64 {
+	return w.size
+}
+
+// Reader rebuilds a stream from its list of chunks
+type Reader struct {
+	s     *Store
+	ids   []ID
+	chunk []byte
+}
+
+// NewReader returns a reader over the chunks of ids read from s
+func NewReader(s *Store, ids []ID) *Reader {
+	return &Reader{
+		s:   s,
+		ids: ids,
+	}
+}
+
+// Read implements io.Reader
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if len(r.ids) == 0 {
+			return 0, io.EOF
+		}
+
+		chunk, err := r.s.Get(r.ids[0])
+		if err != nil {
+			return 0, err
+		}
+
+		r.chunk = chunk
+		r.ids = r.ids[1:]
+	}
+
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
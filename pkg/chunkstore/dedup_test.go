@@ -0,0 +1,117 @@
+package chunkstore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/k1ng440/rolling-hash/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dedup(t *testing.T, s *Store, chunker Chunker, data []byte) []ID {
+	w := NewDedupWriter(s, chunker)
+	_, err := io.Copy(w, bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.Equal(t, int64(len(data)), w.Size())
+
+	res, err := ioutil.ReadAll(NewReader(s, w.IDs()))
+	require.NoError(t, err)
+	assert.Equal(t, data, res)
+
+	return w.IDs()
+}
+
+// newChunks counts the chunks of b missing from a
+func newChunks(a, b []ID) int {
+	known := make(map[ID]bool)
+	for _, id := range a {
+		known[id] = true
+	}
+
+	n := 0
+	for _, id := range b {
+		if !known[id] {
+			n++
+		}
+	}
+
+	return n
+}
+
+func TestDedupFixed(t *testing.T) {
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+	defer s.Close()
+
+	a := testutil.RandomBytes(1, 100*1024+10)
+	b := append([]byte{}, a...)
+	b[50*1024] ^= 0xff
+
+	chunker := &FixedChunker{BlockSize: 4096}
+	first := dedup(t, s, chunker, a)
+	second := dedup(t, s, chunker, b)
+
+	assert.Len(t, first, 26)
+	assert.Equal(t, 1, newChunks(first, second))
+}
+
+func TestFixedChunkerSignatures(t *testing.T) {
+	// more blocks than a batch, with a short last block
+	data := testutil.RandomBytes(1, (fixedBatch*2+3)*16+5)
+	expected, err := delta.GenerateSignatures(bytes.NewReader(data), 16)
+	require.NoError(t, err)
+
+	sigs := make([]*delta.BlockSignature, 0)
+	chunker := &FixedChunker{BlockSize: 16}
+	err = chunker.Signatures(bytes.NewReader(data), func(sig *delta.BlockSignature) error {
+		sigs = append(sigs, sig)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Len(t, sigs, len(expected))
+	for i, sig := range sigs {
+		assert.Equal(t, expected[i].Index, sig.Index)
+		assert.Equal(t, expected[i].Weak, sig.Weak)
+		assert.Equal(t, expected[i].Strong, sig.Strong)
+	}
+}
+
+func TestDedupContentDefined(t *testing.T) {
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+	defer s.Close()
+
+	a := testutil.RandomBytes(1, 512*1024)
+	b := append(append(append([]byte{}, a[:200*1024]...), testutil.RandomBytes(2, 100)...), a[200*1024:]...)
+
+	chunker := NewContentChunker()
+	first := dedup(t, s, chunker, a)
+	second := dedup(t, s, chunker, b)
+
+	// the insertion does not shift the boundaries of the following chunks
+	assert.Greater(t, len(first), 512*1024/DefaultMaxChunkSize)
+	assert.LessOrEqual(t, newChunks(first, second), 2)
+
+	// and no chunk is outside the configured sizes but the last
+	for _, id := range first[:len(first)-1] {
+		chunk, err := s.Get(id)
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, len(chunk), DefaultMinChunkSize)
+		assert.LessOrEqual(t, len(chunk), DefaultMaxChunkSize)
+	}
+}
+
+func TestDedupEmpty(t *testing.T) {
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+	defer s.Close()
+
+	assert.Empty(t, dedup(t, s, NewContentChunker(), []byte{}))
+	assert.Empty(t, dedup(t, s, &FixedChunker{BlockSize: 16}, []byte{}))
+}
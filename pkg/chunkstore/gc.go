@@ -0,0 +1,91 @@
+package chunkstore
+
+import "os"
+
+// Collect removes the chunks without references and returns how many were removed
+func (s *Store) Collect() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sweep()
+}
+
+// GC is a mark and sweep collection: the chunks listed by roots are marked and
+// every other chunk is removed. Reference counts are reset to the references
+// found in roots, fixing counts that drifted from the actual users of the store.
+func (s *Store) GC(roots [][]ID) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs := make(map[ID]int)
+	for _, root := range roots {
+		for _, id := range root {
+			refs[id]++
+		}
+	}
+
+	for id, loc := range s.index.Chunks {
+		loc.Refs = refs[id]
+	}
+
+	return s.sweep()
+}
+
+// sweep removes the chunks without references. Packs holding removed chunks are
+// rewritten with their remaining chunks, and deleted once the index written
+// to disk no longer points at them.
+func (s *Store) sweep() (int, error) {
+	dirty := make(map[int]bool)
+	removed := 0
+	for id, loc := range s.index.Chunks {
+		if loc.Refs <= 0 {
+			dirty[loc.Pack] = true
+			delete(s.index.Chunks, id)
+			removed++
+		}
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+
+	// the current pack may be rewritten, moved chunks go to a new one
+	if err := s.closePack(); err != nil {
+		return 0, err
+	}
+
+	for id, loc := range s.index.Chunks {
+		if !dirty[loc.Pack] {
+			continue
+		}
+
+		record, err := s.readRecord(loc)
+		if err != nil {
+			return 0, err
+		}
+
+		moved, err := s.append(record)
+		if err != nil {
+			return 0, err
+		}
+
+		moved.Refs = loc.Refs
+		s.index.Chunks[id] = moved
+	}
+
+	if err := s.flush(); err != nil {
+		return 0, err
+	}
+
+	// chunks being read from the dirty packs were located before the sweep
+	s.packs.Lock()
+	defer s.packs.Unlock()
+
+	for pack := range dirty {
+		if err := os.Remove(s.packPath(pack)); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
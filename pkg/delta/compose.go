@@ -0,0 +1,58 @@
+package delta
+
+import "errors"
+
+// Compose returns a single patch from the basis of first to the target of second,
+// where second was generated against the target of first. Copies from the
+// intermediate version are rewritten into copies of the first basis, literals or
+// runs, so the intermediate version is never needed.
+func Compose(first, second *Patch) (*Patch, error) {
+	if err := first.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := second.Validate(); err != nil {
+		return nil, err
+	}
+
+	index := newTargetIndex(first)
+	size := first.Size()
+
+	result := &Patch{
+		BlockSize:  first.BlockSize,
+		BasisHash:  first.BasisHash,
+		TargetHash: second.TargetHash,
+	}
+
+	for _, op := range second.Ops {
+		if op.Type != OpCopy {
+			// copies of earlier target bytes keep their offsets in the final target
+			c := *op
+			result.add(&c)
+			continue
+		}
+
+		if op.End > size {
+			return nil, errors.New("patch copies past the target of the previous patch")
+		}
+
+		if err := index.resolve(op.Start, op.End, result.add); err != nil {
+			return nil, err
+		}
+	}
+
+	result.compact()
+	return result, nil
+}
+
+// add appends the operation, merging consecutive literals
+func (p *Patch) add(op *Op) {
+	if n := len(p.Ops); n > 0 && op.Type == OpLiteral && p.Ops[n-1].Type == OpLiteral {
+		prev := p.Ops[n-1]
+		// the literal may be shared with another patch, never append in place
+		prev.Literal = append(prev.Literal[:len(prev.Literal):len(prev.Literal)], op.Literal...)
+		return
+	}
+
+	p.Ops = append(p.Ops, op)
+}
@@ -0,0 +1,56 @@
+package delta
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompose(t *testing.T) {
+	for _, c := range patchCases {
+		t.Run(c.name, func(t *testing.T) {
+			// every case composed with the change back to the first version and on to itself
+			v1, v2, v3 := []byte(c.a), []byte(c.b), []byte(c.a+c.b)
+			first := calculatePatch(t, 16, v1, v2)
+			second := calculatePatch(t, 16, v2, v3)
+
+			composed, err := Compose(first, second)
+			require.NoError(t, err)
+			assert.Equal(t, string(v3), string(applyPatch(t, v1, composed)))
+		})
+	}
+}
+
+func TestComposeChain(t *testing.T) {
+	v1 := testutil.RandomBytes(1, 8192)
+	v2 := append(append(testutil.RandomBytes(2, 100), v1[:4096]...), bytes.Repeat([]byte{9}, 300)...)
+	v2 = append(v2, v1[6000:]...)
+	v3 := append(append([]byte{}, v2[2000:]...), v2[:1500]...)
+	v4 := append(append([]byte{}, v3...), v3[500:3000]...)
+
+	d12 := calculatePatch(t, 64, v1, v2)
+	d23 := calculatePatch(t, 64, v2, v3)
+	d34 := calculatePatch(t, 64, v3, v4)
+
+	d13, err := Compose(d12, d23)
+	require.NoError(t, err)
+	assert.Equal(t, v3, applyPatch(t, v1, d13))
+
+	d14, err := Compose(d13, d34)
+	require.NoError(t, err)
+	assert.Equal(t, v4, applyPatch(t, v1, d14))
+
+	assert.Equal(t, d12.BasisHash, d14.BasisHash)
+	assert.Equal(t, d34.TargetHash, d14.TargetHash)
+}
+
+func TestComposeMismatch(t *testing.T) {
+	first := &Patch{Ops: []*Op{{Type: OpLiteral, Literal: []byte("short")}}}
+	second := &Patch{Ops: []*Op{{Type: OpCopy, Start: 0, End: 16}}}
+
+	_, err := Compose(first, second)
+	assert.Error(t, err)
+}
@@ -3,6 +3,7 @@ package delta
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"errors"
 	"io"
 
@@ -65,77 +66,195 @@ func verifyIntegrity(blockSize int, sigs []*BlockSignature, deltas map[int]*Delt
 }
 
 // GenerateDelta generates diff by calculating and matching signature of given buffer
+// The result is keyed by signature index, see GeneratePatch for the ordered form
 func GenerateDelta(reader io.Reader, blockSize int, signatures []*BlockSignature) (map[int]*Delta, error) {
-	if blockSize == 0 {
-		return nil, errors.New("blockSize must be greater than 0")
-	}
-
 	if len(signatures) == 0 {
 		return nil, errors.New("can not calculate delta from empty signature")
 	}
 
+	patch, err := GeneratePatch(reader, blockSize, signatures)
+	if err != nil {
+		return nil, err
+	}
+
+	index := newTargetIndex(patch)
+	result := make(map[int]*Delta)
+	tempLiteral := make([]byte, 0, blockSize)
+	for _, op := range patch.Ops {
+		switch op.Type {
+		case OpLiteral:
+			tempLiteral = append(tempLiteral, op.Literal...)
+			continue
+
+		case OpCopyTarget:
+			// repeated content of the target is not part of the basis
+			repeated := make([]byte, op.Len())
+			if err := index.readAt(nil, repeated, op.Start); err != nil {
+				return nil, err
+			}
+			tempLiteral = append(tempLiteral, repeated...)
+			continue
+
+		case OpRun:
+			tempLiteral = append(tempLiteral, bytes.Repeat([]byte{op.Value}, op.Count)...)
+			continue
+		}
+
+		// Add the matching delta
+		block := op.Start / blockSize
+		result[block] = &Delta{
+			Start:          block * blockSize,
+			End:            (block * blockSize) + blockSize,
+			Literal:        tempLiteral,
+			SignatureIndex: block,
+		}
+		tempLiteral = make([]byte, 0, blockSize)
+	}
+
+	// Verify the integrity of buffer and missing blocks to result
+	verifyIntegrity(blockSize, signatures, result)
+
+	return result, nil
+}
+
+// GeneratePatch scans the buffer with a rolling hash and returns the operations
+// needed to rebuild it from the basis described by signatures, in target order
+func GeneratePatch(reader io.Reader, blockSize int, signatures []*BlockSignature) (*Patch, error) {
+	if blockSize == 0 {
+		return nil, errors.New("blockSize must be greater than 0")
+	}
+
 	// Initialize the signature lookup map
 	sigMap := make(signatureMap)
 	sigMap.initialize(signatures)
 
-	roll := rollsum.New(DefaultBlockSize)
-	buf := bufio.NewReader(reader)
-	result := make(map[int]*Delta)
+	// Blocks of the target already sent as literal
+	literals := newLiteralIndex(blockSize)
+
+	// Checksum of the whole target
+	targetHash := sha256.New()
+
+	roll := rollsum.New(blockSize)
+	buf := bufio.NewReader(io.TeeReader(reader, targetHash))
+	patch := &Patch{
+		BlockSize: blockSize,
+		BasisHash: SignatureHash(signatures),
+	}
 	tempLiteral := make([]byte, 0, blockSize)
+	offset := 0 // target offset of tempLiteral
+	runValue, runLength := byte(0), 0
 	eof := false // End of file
-	for !eof {
-		// read single byte from the buffer
-		b, err := buf.ReadByte()
-		if err != nil {
-			if err == io.EOF {
-				if roll.Size() == 0 {
-					// Reached the end of the file and rolling hash window is empty
-					break
-				}
+	for {
+		if !eof {
+			// read single byte from the buffer
+			b, err := buf.ReadByte()
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
 
-				// mark as last loop
+			if err == io.EOF {
 				eof = true
 			} else {
-				return nil, err
+				roll.In(b)
+
+				// Count the trailing bytes equal to b, the window holds a single
+				// repeated byte when the count reaches the window size
+				if runLength > 0 && b == runValue {
+					runLength++
+				} else {
+					runValue = b
+					runLength = 1
+				}
+
+				// Build up the rolling hash window to match the block size
+				// Exception: rolling hash window can be smaller if reached the EOF
+				if roll.Size() < blockSize {
+					continue
+				}
 			}
 		}
 
-		// Add byte to rolling hash if we have not reached end of the file
-		// This condition is to prevent adding nil to rolling hash window
-		if !eof {
-			roll.In(b)
+		if roll.Size() == 0 {
+			// Reached the end of the file and rolling hash window is empty
+			break
+		}
 
-			// Build up the rolling hash window to match the block size
-			// Exception: rolling hash window can be smaller if reached the EOF
-			if roll.Size() < blockSize {
-				continue
+		// Match signature of rolling hash, the basis is tried first so that
+		// repeated bytes found in the basis are copied like any other block
+		var match *Op
+		if index := sigMap.match(roll.Sum32(), roll.Window()); index != -1 {
+			match = &Op{
+				Type:  OpCopy,
+				Start: index * blockSize,
+				End:   (index * blockSize) + roll.Size(),
+			}
+		} else if roll.Size() == blockSize && runLength >= blockSize {
+			// a single repeated byte, consume the rest of the run
+			count, err := readRun(buf, runValue)
+			if err != nil {
+				return nil, err
+			}
+
+			match = &Op{
+				Type:  OpRun,
+				Value: runValue,
+				Count: blockSize + count,
+			}
+		} else if source := literals.match(roll.Sum32(), roll.Window()); source != -1 {
+			// the block has already been sent, copy it from the target itself
+			match = &Op{
+				Type:  OpCopyTarget,
+				Start: source,
+				End:   source + roll.Size(),
 			}
 		}
 
-		// Match signature of rolling hash
-		index := sigMap.match(roll.Sum32(), roll.Window())
-		if index == -1 { // no match
+		if match == nil { // no match
 			// Remove the oldest byte from the rolling hash window and store it in diff
 			roll.Out()
 			tempLiteral = append(tempLiteral, roll.Removed())
+
+			// Index every full block of the literal
+			if len(tempLiteral)%blockSize == 0 {
+				literals.add(offset+len(tempLiteral)-blockSize, tempLiteral[len(tempLiteral)-blockSize:])
+			}
 			continue
 		}
 
-		// Add the matching delta
-		result[index] = &Delta{
-			Start:          index * blockSize,
-			End:            (index * blockSize) + blockSize,
-			Literal:        tempLiteral,
-			SignatureIndex: index,
-		}
+		// Add the literal preceding the block and the matching block
+		patch.addLiteral(tempLiteral)
+		patch.Ops = append(patch.Ops, match)
+		offset += len(tempLiteral) + match.Len()
 
 		// Reset rollsum for next window
 		roll.Reset()
 		tempLiteral = make([]byte, 0, blockSize)
 	}
 
-	// Verify the integrity of buffer and missing blocks to result
-	verifyIntegrity(blockSize, signatures, result)
+	// Bytes after the last matching block
+	patch.addLiteral(tempLiteral)
+	patch.TargetHash = targetHash.Sum(nil)
 
-	return result, nil
+	return patch, nil
+}
+
+// readRun consumes the bytes equal to value and returns their count
+func readRun(buf *bufio.Reader, value byte) (int, error) {
+	count := 0
+	for {
+		b, err := buf.ReadByte()
+		if err == io.EOF {
+			return count, nil
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		if b != value {
+			return count, buf.UnreadByte()
+		}
+
+		count++
+	}
 }
@@ -162,3 +162,19 @@ func TestChunkShift(t *testing.T) {
 	assertDiff(t, expect, delta)
 
 }
+
+func TestRepeatedBytesInBasis(t *testing.T) {
+	a := []byte("0123456789abcdef" + string(make([]byte, 32)) + "ghijklmnopqrstuv")
+	b := append([]byte{}, a...)
+
+	_, delta := calculateDiff(t, 16, a, b)
+	printDelta(t, delta)
+
+	// the zero blocks are matched in the basis, not sent as a run
+	assertMissingDelta(t, 0, false, delta)
+	assertMissingDelta(t, 1, false, delta)
+	assertMissingDelta(t, 3, false, delta)
+	for i, d := range delta {
+		assert.Emptyf(t, d.Literal, "Signature Index %d", i)
+	}
+}
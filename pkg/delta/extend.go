@@ -0,0 +1,124 @@
+package delta
+
+import "io"
+
+// extendChunkSize is the number of basis bytes read at once while extending matches
+const extendChunkSize = 4 * 1024
+
+// ExtendMatches grows every copy of the patch byte by byte into its neighbouring
+// literals, as long as the literal bytes are equal to the basis bytes around the
+// copied range. Matches are only found at block granularity, so this removes the
+// unchanged bytes on each side of an edit from the literals.
+func ExtendMatches(patch *Patch, basis io.ReaderAt) error {
+	for i, op := range patch.Ops {
+		if op.Type != OpCopy {
+			continue
+		}
+
+		// extend backward into the tail of the preceding literal
+		if i > 0 && patch.Ops[i-1].Type == OpLiteral {
+			prev := patch.Ops[i-1]
+			n, err := matchBackward(basis, op.Start, prev.Literal)
+			if err != nil {
+				return err
+			}
+
+			op.Start -= n
+			prev.Literal = prev.Literal[:len(prev.Literal)-n]
+		}
+
+		// extend forward into the head of the following literal
+		if i+1 < len(patch.Ops) && patch.Ops[i+1].Type == OpLiteral {
+			next := patch.Ops[i+1]
+			n, err := matchForward(basis, op.End, next.Literal)
+			if err != nil {
+				return err
+			}
+
+			op.End += n
+			next.Literal = next.Literal[n:]
+		}
+	}
+
+	patch.compact()
+	return nil
+}
+
+// GeneratePatchWithBasis generates the patch like GeneratePatch and extends its
+// matches against the basis the signatures were computed from, see ExtendMatches.
+// It is used when both files are local.
+func GeneratePatchWithBasis(reader io.Reader, blockSize int, signatures []*BlockSignature, basis io.ReaderAt) (*Patch, error) {
+	patch, err := GeneratePatch(reader, blockSize, signatures)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ExtendMatches(patch, basis); err != nil {
+		return nil, err
+	}
+
+	return patch, nil
+}
+
+// matchForward returns the length of the common prefix of data and the basis starting at offset
+func matchForward(basis io.ReaderAt, offset int, data []byte) (int, error) {
+	buf := make([]byte, extendChunkSize)
+	matched := 0
+	for matched < len(data) {
+		size := minInt(len(buf), len(data)-matched)
+		n, err := basis.ReadAt(buf[:size], int64(offset+matched))
+		for j := 0; j < n; j++ {
+			if buf[j] != data[matched+j] {
+				return matched + j, nil
+			}
+		}
+
+		matched += n
+		if err == io.EOF {
+			// reached the end of the basis
+			return matched, nil
+		}
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return matched, nil
+}
+
+// matchBackward returns the length of the common suffix of data and the basis ending at offset
+func matchBackward(basis io.ReaderAt, offset int, data []byte) (int, error) {
+	buf := make([]byte, extendChunkSize)
+	matched := 0
+	for matched < len(data) && offset-matched > 0 {
+		size := minInt(len(buf), minInt(len(data)-matched, offset-matched))
+		n, err := basis.ReadAt(buf[:size], int64(offset-matched-size))
+		if n < size {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		// buf covers data[tail-size:tail]
+		tail := len(data) - matched
+		for j := size - 1; j >= 0; j-- {
+			if buf[j] != data[tail-size+j] {
+				return matched + (size - 1 - j), nil
+			}
+		}
+
+		matched += size
+	}
+
+	return matched, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
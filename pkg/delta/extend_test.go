@@ -0,0 +1,71 @@
+package delta
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtendMatches(t *testing.T) {
+	for _, c := range patchCases {
+		t.Run(c.name, func(t *testing.T) {
+			patch := calculatePatch(t, 16, []byte(c.a), []byte(c.b))
+			literals := literalBytes(patch)
+
+			require.NoError(t, ExtendMatches(patch, bytes.NewReader([]byte(c.a))))
+			assert.LessOrEqual(t, literalBytes(patch), literals)
+			assert.Equal(t, c.b, string(applyPatch(t, []byte(c.a), patch)))
+		})
+	}
+}
+
+func TestExtendChunkChange(t *testing.T) {
+	a := []byte("When wintertime rolls in and the days get hot enough that you need to cool off from the blazing heat")
+	b := []byte("When summertime rolls in and the days hot enough that you need to cool off from the blazing heat")
+
+	patch := calculatePatch(t, 16, a, b)
+	require.NoError(t, ExtendMatches(patch, bytes.NewReader(a)))
+
+	// only the differing bytes are left as literal
+	require.Len(t, patch.Ops, 3)
+	assert.Equal(t, "When summ", string(patch.Ops[0].Literal))
+	assert.Equal(t, 9, patch.Ops[1].Start)
+	assert.Equal(t, 38, patch.Ops[1].End)
+	assert.Equal(t, 42, patch.Ops[2].Start)
+	assert.Equal(t, len(a), patch.Ops[2].End)
+}
+
+func TestExtendChunkShift(t *testing.T) {
+	a := []byte("When summertime rolls in and the days get hot enough that you need to cool off from the blazing heat")
+	b := []byte("When summertim   e rolls in and the days get hot enough        that you need to cool off from the blazing heat")
+
+	patch := calculatePatch(t, 16, a, b)
+	require.NoError(t, ExtendMatches(patch, bytes.NewReader(a)))
+
+	literals := make([]string, 0)
+	for _, op := range patch.Ops {
+		if op.Type == OpLiteral {
+			literals = append(literals, string(op.Literal))
+		}
+	}
+	// both copies reuse the single space of the basis
+	assert.Equal(t, []string{"When summertim   ", "      "}, literals)
+}
+
+func TestGeneratePatchWithBasis(t *testing.T) {
+	a := []byte("When wintertime rolls in and the days get hot enough that you need to cool off from the blazing heat")
+	b := []byte("When summertime rolls in and the days hot enough that you need to cool off from the blazing heat")
+
+	sigs, err := GenerateSignatures(bytes.NewReader(a), 16)
+	require.NoError(t, err)
+
+	patch, err := GeneratePatchWithBasis(bytes.NewReader(b), 16, sigs, bytes.NewReader(a))
+	require.NoError(t, err)
+
+	// "When summertime " is not sent as a whole block anymore
+	assert.Equal(t, "When summ", string(patch.Ops[0].Literal))
+	assert.Equal(t, 9, literalBytes(patch))
+	assert.Equal(t, string(b), string(applyPatch(t, a, patch)))
+}
@@ -0,0 +1,374 @@
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"sort"
+)
+
+// moveChunkSize is the number of bytes moved at once by an in place copy
+const moveChunkSize = 32 * 1024
+
+// ReadWriterAt is the storage patched in place, usually the basis file
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// placedOp is an operation along with the target offset it writes to
+type placedOp struct {
+	op     *Op
+	offset int
+}
+
+// inPlaceSchedule orders the copies of the patch so that no copy reads basis
+// bytes already overwritten by another copy. Copies in a dependency cycle can
+// not be ordered: the shortest copy of every strongly connected component of
+// the dependencies is returned as broken, until no cycle is left. Copies only
+// waiting for a cycle stay in the order. The remaining operations do not read
+// the basis and come last, in target order.
+func inPlaceSchedule(patch *Patch) (copies, broken, others []*placedOp) {
+	nodes := make([]*placedOp, 0)
+	offset := 0
+	for _, op := range patch.Ops {
+		p := &placedOp{op: op, offset: offset}
+		if op.Type == OpCopy {
+			nodes = append(nodes, p)
+		} else {
+			others = append(others, p)
+		}
+		offset += op.Len()
+	}
+
+	// edges[u] holds the copies overwriting the basis range read by u,
+	// they have to wait for u. Copies are sorted by target offset.
+	edges := make([][]int, len(nodes))
+	for u, n := range nodes {
+		first := sort.Search(len(nodes), func(v int) bool {
+			return nodes[v].offset+nodes[v].op.Len() > n.op.Start
+		})
+
+		for v := first; v < len(nodes) && nodes[v].offset < n.op.End; v++ {
+			// a copy overlapping itself is moved in the right direction
+			if v != u {
+				edges[u] = append(edges[u], v)
+			}
+		}
+	}
+
+	// broken copies are read before anything is written, nothing waits for them
+	skip := make([]bool, len(nodes))
+	all := make([]int, len(nodes))
+	for v := range all {
+		all[v] = v
+	}
+	breakCycles(nodes, newComponentSearch(edges), all, skip)
+
+	waiting := make([]int, len(nodes))
+	for u := range nodes {
+		for _, v := range edges[u] {
+			if !skip[u] && !skip[v] {
+				waiting[v]++
+			}
+		}
+	}
+
+	ready := make([]int, 0)
+	for v, n := range nodes {
+		if skip[v] {
+			broken = append(broken, n)
+		} else if waiting[v] == 0 {
+			ready = append(ready, v)
+		}
+	}
+
+	for len(ready) > 0 {
+		u := ready[0]
+		ready = ready[1:]
+		copies = append(copies, nodes[u])
+
+		for _, v := range edges[u] {
+			if skip[v] {
+				continue
+			}
+
+			waiting[v]--
+			if waiting[v] == 0 {
+				ready = append(ready, v)
+			}
+		}
+	}
+
+	return copies, broken, others
+}
+
+// breakCycles marks the shortest copy of every strongly connected component of
+// members as broken, then searches the rest of the component again as it may
+// still hold a cycle
+func breakCycles(nodes []*placedOp, search *componentSearch, members []int, broken []bool) {
+	for _, c := range search.run(members) {
+		// a single copy never waits for itself
+		if len(c) < 2 {
+			continue
+		}
+
+		cheapest := 0
+		for i, v := range c {
+			n, m := nodes[v].op.Len(), nodes[c[cheapest]].op.Len()
+			if n < m || (n == m && v < c[cheapest]) {
+				cheapest = i
+			}
+		}
+
+		broken[c[cheapest]] = true
+		rest := append(c[:cheapest:cheapest], c[cheapest+1:]...)
+		breakCycles(nodes, search, rest, broken)
+	}
+}
+
+// componentSearch finds the strongly connected components of a graph with
+// Tarjan's algorithm, restricted to a set of its nodes
+type componentSearch struct {
+	edges [][]int
+	// member marks the nodes of the current search
+	member  []bool
+	onStack []bool
+	// index and low are the visit order of a node and the lowest one it
+	// reaches, zero when not visited yet
+	index   []int
+	low     []int
+	visited int
+	stack   []int
+	found   [][]int
+}
+
+func newComponentSearch(edges [][]int) *componentSearch {
+	return &componentSearch{
+		edges:   edges,
+		member:  make([]bool, len(edges)),
+		onStack: make([]bool, len(edges)),
+		index:   make([]int, len(edges)),
+		low:     make([]int, len(edges)),
+	}
+}
+
+// run returns the strongly connected components of the graph of members,
+// following only the edges between members
+func (s *componentSearch) run(members []int) [][]int {
+	for _, v := range members {
+		s.member[v] = true
+		s.index[v] = 0
+	}
+
+	s.found = nil
+	for _, v := range members {
+		if s.index[v] == 0 {
+			s.connect(v)
+		}
+	}
+
+	for _, v := range members {
+		s.member[v] = false
+	}
+
+	return s.found
+}
+
+func (s *componentSearch) connect(v int) {
+	s.visited++
+	s.index[v], s.low[v] = s.visited, s.visited
+	s.stack = append(s.stack, v)
+	s.onStack[v] = true
+
+	for _, w := range s.edges[v] {
+		switch {
+		case !s.member[w]:
+		case s.index[w] == 0:
+			s.connect(w)
+			s.low[v] = minInt(s.low[v], s.low[w])
+		case s.onStack[w]:
+			s.low[v] = minInt(s.low[v], s.index[w])
+		}
+	}
+
+	if s.low[v] != s.index[v] {
+		return
+	}
+
+	component := make([]int, 0, 1)
+	for {
+		w := s.stack[len(s.stack)-1]
+		s.stack = s.stack[:len(s.stack)-1]
+		s.onStack[w] = false
+		component = append(component, w)
+		if w == v {
+			break
+		}
+	}
+	s.found = append(s.found, component)
+}
+
+// ApplyInPlace applies the patch on top of the basis held by rw, without a
+// second copy of the file. Copies are ordered so that no basis bytes are
+// overwritten before being read, copies in a dependency cycle are buffered in
+// memory first. The storage is not truncated, the target is the first
+// patch.Size() bytes once done.
+func ApplyInPlace(rw ReadWriterAt, patch *Patch) error {
+	if err := patch.Validate(); err != nil {
+		return err
+	}
+
+	if err := VerifyBasis(rw, patch); err != nil {
+		return err
+	}
+
+	copies, broken, others := inPlaceSchedule(patch)
+
+	// read the copies that can not be ordered before anything is written
+	buffers := make([][]byte, len(broken))
+	for i, p := range broken {
+		buffers[i] = make([]byte, p.op.Len())
+		if err := readFull(rw, buffers[i], p.op.Start); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range copies {
+		if err := moveRange(rw, p.op.Start, p.offset, p.op.Len()); err != nil {
+			return err
+		}
+	}
+
+	for i, p := range broken {
+		if _, err := rw.WriteAt(buffers[i], int64(p.offset)); err != nil {
+			return err
+		}
+	}
+
+	// the basis is not needed anymore
+	for _, p := range others {
+		if err := applyAt(rw, p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MakeInPlace turns the copies of the patch that would have to be buffered by
+// ApplyInPlace into literals read from the target, so the patch can be applied
+// in place without extra memory
+func MakeInPlace(patch *Patch, target io.ReaderAt) error {
+	if err := patch.Validate(); err != nil {
+		return err
+	}
+
+	_, broken, _ := inPlaceSchedule(patch)
+	for _, p := range broken {
+		literal := make([]byte, p.op.Len())
+		if err := readFull(target, literal, p.offset); err != nil {
+			return err
+		}
+
+		p.op.Type = OpLiteral
+		p.op.Literal = literal
+		p.op.Start = 0
+		p.op.End = 0
+	}
+
+	return nil
+}
+
+// VerifyTarget checks the rebuilt target against the checksum recorded in the patch
+func VerifyTarget(target io.Reader, patch *Patch) error {
+	if patch.TargetHash == nil {
+		return nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, target); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(h.Sum(nil), patch.TargetHash) {
+		return ErrTargetMismatch
+	}
+
+	return nil
+}
+
+// applyAt writes an operation not reading the basis at its target offset
+func applyAt(rw ReadWriterAt, p *placedOp) error {
+	switch p.op.Type {
+	case OpLiteral:
+		_, err := rw.WriteAt(p.op.Literal, int64(p.offset))
+		return err
+
+	case OpRun:
+		return writeRun(&offsetWriter{w: rw, offset: int64(p.offset)}, p.op)
+
+	case OpCopyTarget:
+		// the source has been written already and is not overwritten again
+		if p.op.End > p.offset {
+			return errTargetCopy
+		}
+		return moveRange(rw, p.op.Start, p.offset, p.op.Len())
+	}
+
+	return errUnknownOp
+}
+
+// moveRange copies n bytes from src to dst, the ranges may overlap
+func moveRange(rw ReadWriterAt, src, dst, n int) error {
+	if src == dst || n == 0 {
+		return nil
+	}
+
+	buf := make([]byte, minInt(n, moveChunkSize))
+	for done := 0; done < n; done += len(buf) {
+		size := minInt(len(buf), n-done)
+
+		// move forward when the destination is before the source, backward otherwise
+		from := done
+		if dst > src {
+			from = n - done - size
+		}
+
+		if err := readFull(rw, buf[:size], src+from); err != nil {
+			return err
+		}
+
+		if _, err := rw.WriteAt(buf[:size], int64(dst+from)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readFull reads len(buf) bytes at offset
+func readFull(r io.ReaderAt, buf []byte, offset int) error {
+	n, err := r.ReadAt(buf, int64(offset))
+	if n == len(buf) {
+		return nil
+	}
+
+	if err == nil || err == io.EOF {
+		return errShortBasis
+	}
+
+	return err
+}
+
+// offsetWriter writes sequentially to w starting at offset
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
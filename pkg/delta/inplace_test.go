@@ -0,0 +1,147 @@
+package delta
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memFile is an in memory file growing on writes past its end
+type memFile struct {
+	data []byte
+}
+
+func (m *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (m *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(m.data) {
+		m.data = append(m.data, make([]byte, end-len(m.data))...)
+	}
+
+	return copy(m.data[off:], p), nil
+}
+
+func applyInPlace(t *testing.T, basis []byte, patch *Patch) []byte {
+	f := &memFile{data: append([]byte{}, basis...)}
+	require.NoError(t, ApplyInPlace(f, patch))
+
+	target := f.data[:patch.Size()]
+	require.NoError(t, VerifyTarget(bytes.NewReader(target), patch))
+	return target
+}
+
+func TestApplyInPlace(t *testing.T) {
+	for _, c := range patchCases {
+		t.Run(c.name, func(t *testing.T) {
+			patch := calculatePatch(t, 16, []byte(c.a), []byte(c.b))
+			assert.Equal(t, c.b, string(applyInPlace(t, []byte(c.a), patch)))
+
+			require.NoError(t, ExtendMatches(patch, bytes.NewReader([]byte(c.a))))
+			assert.Equal(t, c.b, string(applyInPlace(t, []byte(c.a), patch)))
+		})
+	}
+}
+
+func TestApplyInPlaceShift(t *testing.T) {
+	a := testutil.RandomBytes(1, 4096)
+
+	// every copy overwrites the source of its neighbour
+	right := append(testutil.RandomBytes(2, 10), a...)
+	patch := calculatePatch(t, 64, a, right)
+	_, broken, _ := inPlaceSchedule(patch)
+	assert.Empty(t, broken)
+	assert.Equal(t, right, applyInPlace(t, a, patch))
+
+	left := a[10:]
+	patch = calculatePatch(t, 64, a, left)
+	assert.Equal(t, left, applyInPlace(t, a, patch))
+}
+
+func TestApplyInPlaceCycle(t *testing.T) {
+	a := testutil.RandomBytes(1, 256)
+
+	// swapping two halves can not be ordered, block 0 and 2 as well as
+	// block 1 and 3 depend on each other
+	b := append(append([]byte{}, a[128:]...), a[:128]...)
+	patch := calculatePatch(t, 64, a, b)
+	_, broken, _ := inPlaceSchedule(patch)
+	assert.NotEmpty(t, broken)
+	assert.Equal(t, b, applyInPlace(t, a, patch))
+
+	// the generator turns the broken copies into literals
+	require.NoError(t, MakeInPlace(patch, bytes.NewReader(b)))
+	_, broken, _ = inPlaceSchedule(patch)
+	assert.Empty(t, broken)
+	assert.Equal(t, 128, literalBytes(patch))
+	assert.Equal(t, b, applyInPlace(t, a, patch))
+	assert.Equal(t, b, applyPatch(t, a, patch))
+}
+
+func TestApplyInPlaceCopyTarget(t *testing.T) {
+	a := testutil.RandomBytes(1, 256)
+	x := testutil.RandomBytes(2, 64)
+	b := append(append(append([]byte{}, x...), a[:128]...), x...)
+
+	patch := calculatePatch(t, 16, a, b)
+	require.Equal(t, 4, countOps(patch, OpCopyTarget))
+	assert.Equal(t, b, applyInPlace(t, a, patch))
+}
+
+func TestApplyInPlaceBadBasis(t *testing.T) {
+	a := testutil.RandomBytes(1, 256)
+	patch := calculatePatch(t, 16, a, append(testutil.RandomBytes(2, 8), a...))
+
+	f := &memFile{data: testutil.RandomBytes(3, 256)}
+	assert.ErrorIs(t, ApplyInPlace(f, patch), ErrBasisMismatch)
+}
+
+func TestMoveRange(t *testing.T) {
+	data := []byte("0123456789")
+
+	f := &memFile{data: append([]byte{}, data...)}
+	require.NoError(t, moveRange(f, 0, 3, 7))
+	assert.Equal(t, "0120123456", string(f.data))
+
+	f = &memFile{data: append([]byte{}, data...)}
+	require.NoError(t, moveRange(f, 3, 0, 7))
+	assert.Equal(t, "3456789789", string(f.data))
+}
+
+func TestApplyInPlaceCycleChain(t *testing.T) {
+	a := testutil.RandomBytes(1, 48)
+
+	// x and y overwrite the source of each other, c overwrites the source of x
+	// and d overwrites the source of c: only the cycle has to be broken
+	x := &Op{Type: OpCopy, Start: 10, End: 25}
+	y := &Op{Type: OpCopy, Start: 0, End: 10}
+	c := &Op{Type: OpCopy, Start: 24, End: 28}
+	d := &Op{Type: OpCopy, Start: 40, End: 44}
+	patch := &Patch{Ops: []*Op{x, y, c, d}}
+
+	copies, broken, _ := inPlaceSchedule(patch)
+	require.Len(t, broken, 1)
+	assert.Equal(t, y, broken[0].op)
+
+	ops := make([]*Op, len(copies))
+	for i, p := range copies {
+		ops[i] = p.op
+	}
+	assert.Equal(t, []*Op{x, c, d}, ops)
+
+	assert.Equal(t, applyPatch(t, a, patch), applyInPlace(t, a, patch))
+}
@@ -0,0 +1,99 @@
+package delta
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// Invert returns the patch turning the target of patch back into basis, so an
+// update can be rolled back without keeping the basis. Basis bytes copied by the
+// patch are copied back from the target, all other basis bytes become literals.
+func Invert(basis io.ReaderAt, patch *Patch) (*Patch, error) {
+	if err := patch.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := VerifyBasis(basis, patch); err != nil {
+		return nil, err
+	}
+
+	// the copies of the patch by basis offset, along with their target offsets
+	copies := make([]*placedOp, 0)
+	offset := 0
+	for _, op := range patch.Ops {
+		if op.Type == OpCopy && op.Len() > 0 {
+			copies = append(copies, &placedOp{op: op, offset: offset})
+		}
+		offset += op.Len()
+	}
+
+	sort.SliceStable(copies, func(i, j int) bool {
+		return copies[i].op.Start < copies[j].op.Start
+	})
+
+	result := &Patch{BlockSize: patch.BlockSize}
+	if patch.BlockSize > 0 {
+		sum, err := BasisHash(newPatchedReader(basis, patch), patch.BlockSize)
+		if err != nil {
+			return nil, err
+		}
+		result.BasisHash = sum
+	}
+
+	h := sha256.New()
+	r := io.TeeReader(bufio.NewReader(io.NewSectionReader(basis, 0, math.MaxInt64)), h)
+
+	pos := 0
+	for _, p := range copies {
+		if p.op.End <= pos {
+			continue
+		}
+
+		// basis bytes no copy of the patch reads
+		if p.op.Start > pos {
+			literal := make([]byte, p.op.Start-pos)
+			if _, err := io.ReadFull(r, literal); err != nil {
+				return nil, shortBasis(err)
+			}
+
+			result.addLiteral(literal)
+			pos = p.op.Start
+		}
+
+		start := p.offset + pos - p.op.Start
+		result.Ops = append(result.Ops, &Op{
+			Type:  OpCopy,
+			Start: start,
+			End:   start + p.op.End - pos,
+		})
+
+		if _, err := io.CopyN(ioutil.Discard, r, int64(p.op.End-pos)); err != nil {
+			return nil, shortBasis(err)
+		}
+		pos = p.op.End
+	}
+
+	tail, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result.addLiteral(tail)
+	result.TargetHash = h.Sum(nil)
+	result.compact()
+
+	return result, nil
+}
+
+// shortBasis reports a basis ending before the bytes the patch copies from it
+func shortBasis(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errShortBasis
+	}
+
+	return err
+}
@@ -0,0 +1,56 @@
+package delta
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvert(t *testing.T) {
+	// every case of patch_test.go, inverted both ways
+	for _, c := range patchCases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, files := range [][2]string{{c.a, c.b}, {c.b, c.a}} {
+				a, b := []byte(files[0]), []byte(files[1])
+				patch := calculatePatch(t, 16, a, b)
+
+				inverse, err := Invert(bytes.NewReader(a), patch)
+				require.NoError(t, err)
+				assert.Equal(t, string(a), string(applyPatch(t, b, inverse)))
+
+				// inverting twice rebuilds the target again
+				again, err := Invert(bytes.NewReader(b), inverse)
+				require.NoError(t, err)
+				assert.Equal(t, string(b), string(applyPatch(t, a, again)))
+			}
+		})
+	}
+}
+
+func TestInvertCopiesBack(t *testing.T) {
+	a := testutil.RandomBytes(1, 8192)
+	b := append(append(testutil.RandomBytes(2, 100), a[2048:]...), a[:1024]...)
+	patch := calculatePatch(t, 64, a, b)
+
+	inverse, err := Invert(bytes.NewReader(a), patch)
+	require.NoError(t, err)
+	assert.Equal(t, a, applyPatch(t, b, inverse))
+
+	// only the dropped basis bytes travel as literals
+	assert.Equal(t, 1024, literalBytes(inverse))
+}
+
+func TestInvertBasisMismatch(t *testing.T) {
+	a := testutil.RandomBytes(1, 256)
+	patch := calculatePatch(t, 16, a, a)
+
+	_, err := Invert(bytes.NewReader(a[:100]), patch)
+	assert.ErrorIs(t, err, ErrBasisMismatch)
+
+	patch.BasisHash = nil
+	_, err = Invert(bytes.NewReader(a[:100]), patch)
+	assert.ErrorIs(t, err, errShortBasis)
+}
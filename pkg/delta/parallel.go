@@ -0,0 +1,126 @@
+package delta
+
+import (
+	"io"
+	"sync"
+)
+
+// parallelChunkSize is the largest part of an operation applied by a single worker
+const parallelChunkSize = 1024 * 1024
+
+// parallelJob is a part of an operation applied by a worker of ApplyParallel
+type parallelJob struct {
+	op *Op
+	// offset is the target offset of the operation
+	offset int
+	// skip and n select the part of the operation
+	skip, n int
+}
+
+// ApplyParallel applies the patch on top of basis like Apply, but writes the
+// operations concurrently at their target offsets using the given number of
+// workers. Both basis and w must be safe for concurrent use, as *os.File is.
+// The target checksum can not be computed from out of order writes, callers
+// check the written target with VerifyTarget.
+func ApplyParallel(basis io.ReaderAt, patch *Patch, w io.WriterAt, workers int) error {
+	if err := patch.Validate(); err != nil {
+		return err
+	}
+
+	if err := VerifyBasis(basis, patch); err != nil {
+		return err
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	index := newTargetIndex(patch)
+	jobs := make(chan *parallelJob)
+	stop := make(chan struct{})
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, parallelChunkSize)
+			for job := range jobs {
+				if err := applyJob(basis, index, w, job, buf[:job.n]); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+feed:
+	for i, op := range patch.Ops {
+		for skip := 0; skip < op.Len(); skip += parallelChunkSize {
+			job := &parallelJob{
+				op:     op,
+				offset: index.offsets[i],
+				skip:   skip,
+				n:      minInt(parallelChunkSize, op.Len()-skip),
+			}
+
+			select {
+			case jobs <- job:
+			case <-stop:
+				break feed
+			}
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	return firstErr
+}
+
+// applyJob writes a part of an operation at its target offset, buf holds job.n bytes
+func applyJob(basis io.ReaderAt, index *targetIndex, w io.WriterAt, job *parallelJob, buf []byte) error {
+	op := job.op
+	switch op.Type {
+	case OpLiteral:
+		buf = op.Literal[job.skip : job.skip+job.n]
+
+	case OpCopy:
+		if err := readFull(basis, buf, op.Start+job.skip); err != nil {
+			return err
+		}
+
+	case OpRun:
+		for i := range buf {
+			buf[i] = op.Value
+		}
+
+	case OpCopyTarget:
+		// the source is resolved from the patch, it may not be written yet
+		if op.End > job.offset {
+			return errTargetCopy
+		}
+
+		if err := index.readAt(basis, buf, op.Start+job.skip); err != nil {
+			return err
+		}
+
+	default:
+		return errUnknownOp
+	}
+
+	_, err := w.WriteAt(buf, int64(job.offset+job.skip))
+	return err
+}
@@ -0,0 +1,52 @@
+package delta
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func applyParallel(t *testing.T, basis []byte, patch *Patch, workers int) []byte {
+	// pre-sized so that concurrent writes never grow the file
+	out := &memFile{data: make([]byte, patch.Size())}
+	require.NoError(t, ApplyParallel(bytes.NewReader(basis), patch, out, workers))
+	require.NoError(t, VerifyTarget(bytes.NewReader(out.data), patch))
+	return out.data
+}
+
+func TestApplyParallel(t *testing.T) {
+	for _, c := range patchCases {
+		t.Run(c.name, func(t *testing.T) {
+			patch := calculatePatch(t, 16, []byte(c.a), []byte(c.b))
+			assert.Equal(t, c.b, string(applyParallel(t, []byte(c.a), patch, 4)))
+		})
+	}
+}
+
+func TestApplyParallelLarge(t *testing.T) {
+	a := testutil.RandomBytes(1, 3*parallelChunkSize)
+	b := append(append(testutil.RandomBytes(2, 1000), a[parallelChunkSize:]...), bytes.Repeat([]byte{7}, 2*parallelChunkSize+5)...)
+	b = append(b, a[:parallelChunkSize/2]...)
+	literal := testutil.RandomBytes(3, 5000)
+	b = append(append(b, literal...), literal...)
+
+	patch := calculatePatch(t, 512, a, b)
+	require.NotZero(t, countOps(patch, OpCopyTarget))
+
+	for _, workers := range []int{0, 1, 3, 8} {
+		assert.Equal(t, b, applyParallel(t, a, patch, workers))
+	}
+}
+
+func TestApplyParallelShortBasis(t *testing.T) {
+	a := testutil.RandomBytes(1, 4096)
+	patch := calculatePatch(t, 16, a, a)
+	patch.BasisHash = nil
+
+	out := &memFile{data: make([]byte, patch.Size())}
+	err := ApplyParallel(bytes.NewReader(a[:100]), patch, out, 4)
+	assert.ErrorIs(t, err, errShortBasis)
+}
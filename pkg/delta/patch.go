@@ -0,0 +1,318 @@
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+)
+
+// OpType identifies the kind of a patch operation
+type OpType uint8
+
+const (
+	// OpCopy copies the basis bytes between Start and End
+	OpCopy OpType = iota
+	// OpLiteral writes the bytes held by Literal
+	OpLiteral
+	// OpCopyTarget copies the target bytes between Start and End, which must
+	// have been written by earlier operations
+	OpCopyTarget
+	// OpRun writes Value repeated Count times
+	OpRun
+)
+
+// targetCopyChunkSize is the number of target bytes resolved at once by OpCopyTarget
+const targetCopyChunkSize = 32 * 1024
+
+var (
+	// ErrBasisMismatch is returned when the basis is not the one the patch was generated against
+	ErrBasisMismatch = errors.New("basis does not match the patch")
+	// ErrTargetMismatch is returned when the rebuilt target does not match the patch checksum
+	ErrTargetMismatch = errors.New("rebuilt target does not match the patch checksum")
+
+	errUnknownOp  = errors.New("unknown patch operation")
+	errInvalidOp  = errors.New("invalid patch operation")
+	errShortBasis = errors.New("basis is shorter than the patch expects")
+	errTargetCopy = errors.New("target copy must reference earlier output")
+)
+
+// Op is a single operation of a Patch
+type Op struct {
+	Type OpType
+	// Basis byte range used by OpCopy, target byte range used by OpCopyTarget
+	Start int
+	End   int
+	// Literal bytes written by OpLiteral
+	Literal []byte
+	// Repeated byte and length of OpRun. Delta files compressing every literal
+	// on its own also record the decompressed size of a literal in Count.
+	Value byte
+	Count int
+}
+
+// Len returns the number of bytes the operation writes to the target
+func (op *Op) Len() int {
+	switch op.Type {
+	case OpLiteral:
+		return len(op.Literal)
+	case OpRun:
+		return op.Count
+	}
+
+	return op.End - op.Start
+}
+
+// Patch is the ordered form of a delta. Applying the operations in order
+// on top of the basis rebuilds the target.
+type Patch struct {
+	BlockSize int
+	Ops       []*Op
+	// BasisHash is the SignatureHash of the basis the patch was generated against
+	BasisHash []byte
+	// TargetHash is the sha256 hash of the whole target
+	TargetHash []byte
+}
+
+// addLiteral appends a literal operation, empty literals are ignored
+func (p *Patch) addLiteral(literal []byte) {
+	if len(literal) == 0 {
+		return
+	}
+
+	p.Ops = append(p.Ops, &Op{
+		Type:    OpLiteral,
+		Literal: literal,
+	})
+}
+
+// Size returns the size of the target rebuilt by the patch
+func (p *Patch) Size() int {
+	size := 0
+	for _, op := range p.Ops {
+		size += op.Len()
+	}
+
+	return size
+}
+
+// Validate checks the operations of a patch read from an untrusted source:
+// ranges must not be reversed or negative, runs must not have a negative
+// length and target copies must only read earlier output.
+func (p *Patch) Validate() error {
+	offset := 0
+	for i, op := range p.Ops {
+		switch op.Type {
+		case OpLiteral:
+
+		case OpCopy, OpCopyTarget:
+			if op.Start < 0 || op.End < op.Start {
+				return fmt.Errorf("operation %d: %w", i, errInvalidOp)
+			}
+
+			if op.Type == OpCopyTarget && op.End > offset {
+				return fmt.Errorf("operation %d: %w", i, errTargetCopy)
+			}
+
+		case OpRun:
+			if op.Count < 0 {
+				return fmt.Errorf("operation %d: %w", i, errInvalidOp)
+			}
+
+		default:
+			return fmt.Errorf("operation %d: %w", i, errUnknownOp)
+		}
+
+		if offset+op.Len() < offset {
+			return errors.New("patch target is too large")
+		}
+		offset += op.Len()
+	}
+
+	return nil
+}
+
+// Apply rebuilds the target by applying the patch on top of basis and writes it to w.
+// The basis is checked against the patch fingerprint before anything is written and
+// the target checksum is verified once the last operation has been applied.
+func Apply(basis io.ReaderAt, patch *Patch, w io.Writer) error {
+	if err := patch.Validate(); err != nil {
+		return err
+	}
+
+	if err := VerifyBasis(basis, patch); err != nil {
+		return err
+	}
+
+	var h hash.Hash
+	if patch.TargetHash != nil {
+		h = sha256.New()
+		w = io.MultiWriter(w, h)
+	}
+
+	var index *targetIndex
+	offset := 0
+	for _, op := range patch.Ops {
+		switch op.Type {
+		case OpLiteral:
+			if _, err := w.Write(op.Literal); err != nil {
+				return err
+			}
+
+		case OpCopy:
+			n, err := io.Copy(w, io.NewSectionReader(basis, int64(op.Start), int64(op.Len())))
+			if err != nil {
+				return err
+			}
+
+			if n != int64(op.Len()) {
+				return errShortBasis
+			}
+
+		case OpCopyTarget:
+			if op.End > offset {
+				return errTargetCopy
+			}
+
+			if index == nil {
+				index = newTargetIndex(patch)
+			}
+
+			if err := copyTarget(w, basis, index, op); err != nil {
+				return err
+			}
+
+		case OpRun:
+			if err := writeRun(w, op); err != nil {
+				return err
+			}
+
+		default:
+			return errUnknownOp
+		}
+
+		offset += op.Len()
+	}
+
+	if h != nil && !bytes.Equal(h.Sum(nil), patch.TargetHash) {
+		return ErrTargetMismatch
+	}
+
+	return nil
+}
+
+// VerifyBasis checks the basis against the fingerprint recorded in the patch.
+// Patches without fingerprint accept any basis.
+func VerifyBasis(basis io.ReaderAt, patch *Patch) error {
+	if patch.BasisHash == nil {
+		return nil
+	}
+
+	sum, err := BasisHash(io.NewSectionReader(basis, 0, math.MaxInt64), patch.BlockSize)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(sum, patch.BasisHash) {
+		return ErrBasisMismatch
+	}
+
+	return nil
+}
+
+// ApplyRange writes the target bytes from start to end to w. Unlike Apply, neither
+// the basis nor the target is verified, it is used to continue an interrupted
+// Apply where the caller checks the output itself.
+func ApplyRange(basis io.ReaderAt, patch *Patch, w io.Writer, start, end int) error {
+	if start < 0 || start > end || end > patch.Size() {
+		return errors.New("range is out of the patch target")
+	}
+
+	if err := patch.Validate(); err != nil {
+		return err
+	}
+
+	index := newTargetIndex(patch)
+	buf := make([]byte, minInt(end-start, targetCopyChunkSize))
+	for offset := start; offset < end; offset += len(buf) {
+		chunk := buf[:minInt(len(buf), end-offset)]
+		if err := index.readAt(basis, chunk, offset); err != nil {
+			return err
+		}
+
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyTarget writes the earlier target bytes referenced by op to w
+func copyTarget(w io.Writer, basis io.ReaderAt, index *targetIndex, op *Op) error {
+	buf := make([]byte, minInt(op.Len(), targetCopyChunkSize))
+	for start := op.Start; start < op.End; start += len(buf) {
+		chunk := buf[:minInt(len(buf), op.End-start)]
+		if err := index.readAt(basis, chunk, start); err != nil {
+			return err
+		}
+
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeRun writes the repeated byte of op to w
+func writeRun(w io.Writer, op *Op) error {
+	buf := bytes.Repeat([]byte{op.Value}, minInt(op.Count, targetCopyChunkSize))
+	for left := op.Count; left > 0; left -= len(buf) {
+		if _, err := w.Write(buf[:minInt(len(buf), left)]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compact drops empty operations and merges copies of contiguous ranges
+func (p *Patch) compact() {
+	ops := make([]*Op, 0, len(p.Ops))
+	offset := 0
+	for _, op := range p.Ops {
+		if op.Len() == 0 {
+			continue
+		}
+
+		if n := len(ops); n > 0 && op.Type == OpRun && ops[n-1].Type == OpRun && ops[n-1].Value == op.Value {
+			ops[n-1].Count += op.Count
+			offset += op.Len()
+			continue
+		}
+
+		if n := len(ops); n > 0 && op.Type == ops[n-1].Type && ops[n-1].End == op.Start {
+			prev := ops[n-1]
+			merge := op.Type == OpCopy
+			if op.Type == OpCopyTarget {
+				// the merged copy must still read from earlier output only
+				merge = op.End <= offset-prev.Len()
+			}
+
+			if merge {
+				prev.End = op.End
+				offset += op.Len()
+				continue
+			}
+		}
+
+		ops = append(ops, op)
+		offset += op.Len()
+	}
+
+	p.Ops = ops
+}
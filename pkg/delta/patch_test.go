@@ -0,0 +1,225 @@
+package delta
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func calculatePatch(t *testing.T, blockSize int, fileA, fileB []byte) *Patch {
+	signatures, err := GenerateSignatures(bytes.NewReader(fileA), blockSize)
+	require.NoError(t, err)
+
+	patch, err := GeneratePatch(bytes.NewReader(fileB), blockSize, signatures)
+	require.NoError(t, err)
+
+	return patch
+}
+
+func applyPatch(t *testing.T, basis []byte, patch *Patch) []byte {
+	out := new(bytes.Buffer)
+	require.NoError(t, Apply(bytes.NewReader(basis), patch, out))
+	return out.Bytes()
+}
+
+func literalBytes(patch *Patch) int {
+	n := 0
+	for _, op := range patch.Ops {
+		if op.Type == OpLiteral {
+			n += len(op.Literal)
+		}
+	}
+
+	return n
+}
+
+var patchCases = []struct {
+	name string
+	a, b string
+}{
+	{"end of file", "Be yourself", "Be yourself"},
+	{"equal", "Be yourself; everyone else is already taken. - Oscar Wilde", "Be yourself; everyone else is already taken. - Oscar Wilde"},
+	{"change", "When wintertime rolls in and the days get hot enough that you need to cool off from the blazing heat", "When summertime rolls in and the days hot enough that you need to cool off from the blazing heat"},
+	{"addition", "When summertime rolls in and the days get hot enough that you need to cool off from the blazing heat", "When summertime rolls in and the days get hot en ..... new additionough that you need to cool off from the blazing heat"},
+	{"removal", "When summertime rolls in and the days get hot enough that you need to cool off from the blazing heat", "rolls in and the days get hot enough that you ne rom the blazing heat"},
+	{"shift", "When summertime rolls in and the days get hot enough that you need to cool off from the blazing heat", "When summertim   e rolls in and the days get hot enough        that you need to cool off from the blazing heat"},
+	{"reorder", "0123456789abcdefghijklmnopqrstuv", "ghijklmnopqrstuv0123456789abcdef0123456789abcdef"},
+	{"trailing literal", "0123456789abcdef", "0123456789abcdef and more"},
+}
+
+func TestApplyPatch(t *testing.T) {
+	for _, c := range patchCases {
+		t.Run(c.name, func(t *testing.T) {
+			patch := calculatePatch(t, 16, []byte(c.a), []byte(c.b))
+			assert.Equal(t, len(c.b), patch.Size())
+			assert.Equal(t, c.b, string(applyPatch(t, []byte(c.a), patch)))
+		})
+	}
+}
+
+func TestPatchShortLastBlock(t *testing.T) {
+	a := []byte("0123456789abcdefXYZ")
+	b := []byte("new 0123456789abcdefXYZ")
+	patch := calculatePatch(t, 16, a, b)
+
+	require.Len(t, patch.Ops, 3)
+	assert.Equal(t, "new ", string(patch.Ops[0].Literal))
+	assert.Equal(t, OpCopy, patch.Ops[2].Type)
+	assert.Equal(t, 16, patch.Ops[2].Start)
+	assert.Equal(t, len(a), patch.Ops[2].End)
+}
+
+func TestApplyShortBasis(t *testing.T) {
+	a := []byte("0123456789abcdef")
+	patch := calculatePatch(t, 16, a, a)
+
+	err := Apply(bytes.NewReader(a[:8]), patch, new(bytes.Buffer))
+	assert.Error(t, err)
+}
+
+func TestPatchRun(t *testing.T) {
+	a := testutil.RandomBytes(1, 256)
+	b := append([]byte{}, a[:100]...)
+	b = append(b, make([]byte, 1000)...)
+	b = append(b, a[100:]...)
+
+	patch := calculatePatch(t, 16, a, b)
+	require.Equal(t, 1, countOps(patch, OpRun))
+	for _, op := range patch.Ops {
+		if op.Type == OpRun {
+			assert.Equal(t, byte(0), op.Value)
+			assert.Equal(t, 1000, op.Count)
+		}
+	}
+	assert.Equal(t, 16, literalBytes(patch))
+	assert.Equal(t, b, applyPatch(t, a, patch))
+}
+
+func TestPatchRunInsteadOfLiterals(t *testing.T) {
+	a := testutil.RandomBytes(1, 256)
+	b := bytes.Repeat([]byte{0xff}, 1024)
+
+	// a single run instead of a literal for every block
+	patch := calculatePatch(t, 16, a, b)
+	require.Len(t, patch.Ops, 1)
+	assert.Equal(t, OpRun, patch.Ops[0].Type)
+	assert.Equal(t, b, applyPatch(t, a, patch))
+}
+
+func TestPatchRunInBasis(t *testing.T) {
+	a := bytes.Repeat([]byte{0xff}, 256)
+	b := bytes.Repeat([]byte{0xff}, 1024)
+
+	// repeated bytes found in the basis are copied
+	patch := calculatePatch(t, 16, a, b)
+	assert.Zero(t, countOps(patch, OpRun))
+	assert.Zero(t, literalBytes(patch))
+	assert.Equal(t, b, applyPatch(t, a, patch))
+}
+
+func TestBasisHash(t *testing.T) {
+	a := testutil.RandomBytes(1, 1000)
+	sigs, err := GenerateSignatures(bytes.NewReader(a), 16)
+	require.NoError(t, err)
+
+	sum, err := BasisHash(bytes.NewReader(a), 16)
+	require.NoError(t, err)
+	assert.Equal(t, SignatureHash(sigs), sum)
+
+	sum, err = BasisHash(bytes.NewReader(a[:999]), 16)
+	require.NoError(t, err)
+	assert.NotEqual(t, SignatureHash(sigs), sum)
+}
+
+func TestApplyVerifiesBasis(t *testing.T) {
+	a := testutil.RandomBytes(1, 256)
+	b := append(testutil.RandomBytes(2, 32), a...)
+	patch := calculatePatch(t, 16, a, b)
+
+	// a byte changed in the basis is refused before anything is written
+	changed := append([]byte{}, a...)
+	changed[200] ^= 0xff
+
+	out := new(bytes.Buffer)
+	err := Apply(bytes.NewReader(changed), patch, out)
+	assert.ErrorIs(t, err, ErrBasisMismatch)
+	assert.Zero(t, out.Len())
+}
+
+func TestApplyVerifiesTarget(t *testing.T) {
+	a := testutil.RandomBytes(1, 256)
+	b := append(testutil.RandomBytes(2, 32), a...)
+	patch := calculatePatch(t, 16, a, b)
+	require.Equal(t, OpLiteral, patch.Ops[0].Type)
+
+	patch.Ops[0].Literal[0] ^= 0xff
+	err := Apply(bytes.NewReader(a), patch, new(bytes.Buffer))
+	assert.ErrorIs(t, err, ErrTargetMismatch)
+}
+
+func TestApplyRange(t *testing.T) {
+	for _, c := range patchCases {
+		t.Run(c.name, func(t *testing.T) {
+			patch := calculatePatch(t, 16, []byte(c.a), []byte(c.b))
+
+			// every split of the target rebuilds the same bytes
+			for split := 0; split <= len(c.b); split += 7 {
+				out := new(bytes.Buffer)
+				require.NoError(t, ApplyRange(bytes.NewReader([]byte(c.a)), patch, out, 0, split))
+				require.NoError(t, ApplyRange(bytes.NewReader([]byte(c.a)), patch, out, split, len(c.b)))
+				assert.Equal(t, c.b, out.String())
+			}
+		})
+	}
+
+	patch := calculatePatch(t, 16, []byte(patchCases[0].a), []byte(patchCases[0].b))
+	assert.Error(t, ApplyRange(bytes.NewReader(nil), patch, new(bytes.Buffer), 0, patch.Size()+1))
+	assert.Error(t, ApplyRange(bytes.NewReader(nil), patch, new(bytes.Buffer), 4, 2))
+}
+
+func TestPatchValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		op   *Op
+		err  error
+	}{
+		{"negative run", &Op{Type: OpRun, Value: 1, Count: -1}, errInvalidOp},
+		{"reversed copy", &Op{Type: OpCopy, Start: 8, End: 4}, errInvalidOp},
+		{"negative copy", &Op{Type: OpCopy, Start: -4, End: 4}, errInvalidOp},
+		{"reversed target copy", &Op{Type: OpCopyTarget, Start: 2, End: 1}, errInvalidOp},
+		{"negative target copy", &Op{Type: OpCopyTarget, Start: -1, End: 1}, errInvalidOp},
+		{"target copy ahead", &Op{Type: OpCopyTarget, Start: 0, End: 5}, errTargetCopy},
+		{"unknown", &Op{Type: OpRun + 1}, errUnknownOp},
+	}
+
+	basis := []byte("0123456789")
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			patch := &Patch{Ops: []*Op{{Type: OpLiteral, Literal: []byte("abcd")}, c.op}}
+			assert.ErrorIs(t, patch.Validate(), c.err)
+
+			// corrupt operations are refused by every entry point instead of panicking
+			assert.ErrorIs(t, Apply(bytes.NewReader(basis), patch, new(bytes.Buffer)), c.err)
+			assert.ErrorIs(t, ApplyParallel(bytes.NewReader(basis), patch, &memFile{data: make([]byte, 16)}, 2), c.err)
+			assert.ErrorIs(t, ApplyRange(bytes.NewReader(basis), patch, new(bytes.Buffer), 0, 0), c.err)
+
+			_, err := NewPatchedReader(bytes.NewReader(basis), patch)
+			assert.ErrorIs(t, err, c.err)
+
+			_, err = Invert(bytes.NewReader(basis), patch)
+			assert.ErrorIs(t, err, c.err)
+
+			valid := &Patch{Ops: []*Op{{Type: OpCopy, Start: 0, End: 10}}}
+			_, err = Compose(valid, patch)
+			assert.ErrorIs(t, err, c.err)
+			_, err = Compose(patch, valid)
+			assert.ErrorIs(t, err, c.err)
+		})
+	}
+
+	patch := calculatePatch(t, 16, []byte(patchCases[0].a), []byte(patchCases[0].b))
+	assert.NoError(t, patch.Validate())
+}
@@ -0,0 +1,62 @@
+package delta
+
+import "sort"
+
+// Range is a byte range of a file, End is excluded
+type Range struct {
+	Start int
+	End   int
+}
+
+// Len returns the number of bytes in the range
+func (r Range) Len() int {
+	return r.End - r.Start
+}
+
+// coalesceRanges sorts the ranges and merges the overlapping and adjacent ones
+func coalesceRanges(ranges []Range) []Range {
+	sorted := make([]Range, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	result := make([]Range, 0, len(sorted))
+	for _, r := range sorted {
+		if r.Len() <= 0 {
+			continue
+		}
+
+		if n := len(result); n > 0 && r.Start <= result[n-1].End {
+			if r.End > result[n-1].End {
+				result[n-1].End = r.End
+			}
+			continue
+		}
+
+		result = append(result, r)
+	}
+
+	return result
+}
+
+// BasisRanges returns the sorted and coalesced basis ranges read by the patch,
+// along with the number of basis bytes they cover. Copies of earlier target
+// bytes read basis ranges already listed for the copies they resolve to.
+func BasisRanges(patch *Patch) ([]Range, int) {
+	ranges := make([]Range, 0)
+	for _, op := range patch.Ops {
+		if op.Type == OpCopy {
+			ranges = append(ranges, Range{Start: op.Start, End: op.End})
+		}
+	}
+
+	ranges = coalesceRanges(ranges)
+
+	total := 0
+	for _, r := range ranges {
+		total += r.Len()
+	}
+
+	return ranges, total
+}
@@ -0,0 +1,49 @@
+package delta
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBasisRanges(t *testing.T) {
+	patch := &Patch{
+		Ops: []*Op{
+			{Type: OpCopy, Start: 64, End: 96},
+			{Type: OpLiteral, Literal: []byte("new")},
+			{Type: OpCopy, Start: 0, End: 32},
+			{Type: OpCopyTarget, Start: 0, End: 16},
+			{Type: OpCopy, Start: 32, End: 48},
+			{Type: OpRun, Value: 1, Count: 100},
+			{Type: OpCopy, Start: 80, End: 128},
+		},
+	}
+
+	ranges, total := BasisRanges(patch)
+	assert.Equal(t, []Range{{0, 48}, {64, 128}}, ranges)
+	assert.Equal(t, 112, total)
+}
+
+func TestBasisRangesApply(t *testing.T) {
+	a := testutil.RandomBytes(1, 4096)
+	b := append(append([]byte{}, a[1024:2048]...), a[3072:]...)
+	patch := calculatePatch(t, 64, a, b)
+
+	ranges, total := BasisRanges(patch)
+	assert.Equal(t, []Range{{1024, 2048}, {3072, 4096}}, ranges)
+	assert.Equal(t, 2048, total)
+
+	// a basis holding only the listed ranges is enough
+	partial := make([]byte, len(a))
+	for _, r := range ranges {
+		copy(partial[r.Start:r.End], a[r.Start:r.End])
+	}
+
+	patch.BasisHash = nil
+	out := new(bytes.Buffer)
+	require.NoError(t, Apply(bytes.NewReader(partial), patch, out))
+	assert.Equal(t, b, out.Bytes())
+}
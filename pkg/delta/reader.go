@@ -0,0 +1,93 @@
+package delta
+
+import (
+	"errors"
+	"io"
+)
+
+// PatchedReader reads the target of a patch without writing it anywhere. Reads
+// are resolved to basis ranges or literal bytes through an index of the
+// operation offsets, the basis is not verified, see VerifyBasis.
+type PatchedReader struct {
+	basis  io.ReaderAt
+	index  *targetIndex
+	size   int64
+	offset int64
+}
+
+// NewPatchedReader returns a reader over the target of the patch applied on top of basis
+func NewPatchedReader(basis io.ReaderAt, patch *Patch) (*PatchedReader, error) {
+	if err := patch.Validate(); err != nil {
+		return nil, err
+	}
+
+	return newPatchedReader(basis, patch), nil
+}
+
+// newPatchedReader returns a reader over the target of a patch already validated
+func newPatchedReader(basis io.ReaderAt, patch *Patch) *PatchedReader {
+	return &PatchedReader{
+		basis: basis,
+		index: newTargetIndex(patch),
+		size:  int64(patch.Size()),
+	}
+}
+
+// Size returns the size of the target
+func (r *PatchedReader) Size() int64 {
+	return r.size
+}
+
+// ReadAt implements io.ReaderAt
+func (r *PatchedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	var err error
+	if left := r.size - off; int64(len(p)) > left {
+		p = p[:left]
+		err = io.EOF
+	}
+
+	if err := r.index.readAt(r.basis, p, int(off)); err != nil {
+		return 0, err
+	}
+
+	return len(p), err
+}
+
+// Read implements io.Reader
+func (r *PatchedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (r *PatchedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.offset = offset
+	return offset, nil
+}
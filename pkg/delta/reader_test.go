@@ -0,0 +1,62 @@
+package delta
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/k1ng440/rolling-hash/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatchedReader(t *testing.T) {
+	for _, c := range patchCases {
+		t.Run(c.name, func(t *testing.T) {
+			patch := calculatePatch(t, 16, []byte(c.a), []byte(c.b))
+
+			r, err := NewPatchedReader(bytes.NewReader([]byte(c.a)), patch)
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(c.b)), r.Size())
+			assert.NoError(t, iotest.TestReader(r, []byte(c.b)))
+		})
+	}
+}
+
+func TestPatchedReaderRandomAccess(t *testing.T) {
+	a := testutil.RandomBytes(1, 8192)
+	b := append(append(testutil.RandomBytes(2, 100), a[4096:]...), bytes.Repeat([]byte{0}, 1000)...)
+	b = append(b, a[:2048]...)
+	patch := calculatePatch(t, 64, a, b)
+
+	r, err := NewPatchedReader(bytes.NewReader(a), patch)
+	require.NoError(t, err)
+	for _, off := range []int{0, 99, 100, 4195, 5000, len(b) - 2048, len(b) - 10} {
+		buf := make([]byte, 300)
+		n, err := r.ReadAt(buf, int64(off))
+		if off+len(buf) > len(b) {
+			assert.Equal(t, io.EOF, err)
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, b[off:off+n], buf[:n])
+	}
+
+	_, err = r.Seek(-2048, io.SeekEnd)
+	require.NoError(t, err)
+	res, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, a[:2048], res)
+}
+
+func TestPatchedReaderShortBasis(t *testing.T) {
+	a := testutil.RandomBytes(1, 256)
+	patch := calculatePatch(t, 16, a, a)
+
+	r, err := NewPatchedReader(bytes.NewReader(a[:100]), patch)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.ErrorIs(t, err, errShortBasis)
+}
@@ -0,0 +1,137 @@
+package delta
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+)
+
+// DefaultRefineFactor is the ratio between the coarse and the fine block size
+const DefaultRefineFactor = 8
+
+// Refinement asks the basis holder for fine grained signatures of a basis range,
+// so a literal of a coarse patch can be diffed again with a smaller block size
+type Refinement struct {
+	// Op is the index of the literal in the coarse patch
+	Op int
+	// Start and End are the basis range expected to hold the old version of the literal.
+	// End is -1 when the range runs to the end of the basis
+	Start int
+	End   int
+	// BlockSize of the fine signatures
+	BlockSize int
+	// Signatures of the basis range, filled in by SignRefinements
+	Signatures []*BlockSignature
+}
+
+// Refinements returns a refinement for every literal of the coarse patch that is
+// large enough to hold a fine block. The basis range of a literal is the gap
+// between the copies around it.
+func Refinements(patch *Patch, blockSize int) ([]*Refinement, error) {
+	if blockSize <= 0 {
+		return nil, errors.New("blockSize must be greater than 0")
+	}
+
+	result := make([]*Refinement, 0)
+	prevEnd := 0
+	for i, op := range patch.Ops {
+		if op.Type == OpCopy {
+			prevEnd = op.End
+			continue
+		}
+
+		if op.Type != OpLiteral || len(op.Literal) < blockSize {
+			continue
+		}
+
+		nextStart := -1
+		for _, next := range patch.Ops[i+1:] {
+			if next.Type == OpCopy {
+				nextStart = next.Start
+				break
+			}
+		}
+
+		// copies around the literal are out of order, there is no gap to look into
+		if nextStart != -1 && nextStart-prevEnd < blockSize {
+			continue
+		}
+
+		result = append(result, &Refinement{
+			Op:        i,
+			Start:     prevEnd,
+			End:       nextStart,
+			BlockSize: blockSize,
+		})
+	}
+
+	return result, nil
+}
+
+// SignRefinements generates the fine signatures of every refinement from the basis
+func SignRefinements(basis io.ReaderAt, refinements []*Refinement) error {
+	for _, r := range refinements {
+		size := math.MaxInt64 - int64(r.Start)
+		if r.End != -1 {
+			size = int64(r.End - r.Start)
+		}
+
+		sigs, err := GenerateSignatures(io.NewSectionReader(basis, int64(r.Start), size), r.BlockSize)
+		if err != nil {
+			return err
+		}
+
+		r.Signatures = sigs
+	}
+
+	return nil
+}
+
+// RefinePatch diffs the refined literals of the coarse patch against their fine
+// signatures and returns a new patch with the literals replaced by the result
+func RefinePatch(patch *Patch, refinements []*Refinement) (*Patch, error) {
+	refined := make(map[int]*Refinement)
+	for _, r := range refinements {
+		if r.Op < 0 || r.Op >= len(patch.Ops) || patch.Ops[r.Op].Type != OpLiteral {
+			return nil, errors.New("refinement does not point to a literal of the patch")
+		}
+
+		refined[r.Op] = r
+	}
+
+	result := *patch
+	result.Ops = nil
+	offset := 0 // target offset of op
+	for i, op := range patch.Ops {
+		r, ok := refined[i]
+		if !ok || len(r.Signatures) == 0 {
+			result.Ops = append(result.Ops, op)
+			offset += op.Len()
+			continue
+		}
+
+		sub, err := GeneratePatch(bytes.NewReader(op.Literal), r.BlockSize, r.Signatures)
+		if err != nil {
+			return nil, err
+		}
+
+		// fine signatures are relative to the start of the range
+		// and repeated content is relative to the start of the literal
+		for _, subOp := range sub.Ops {
+			switch subOp.Type {
+			case OpCopy:
+				subOp.Start += r.Start
+				subOp.End += r.Start
+			case OpCopyTarget:
+				subOp.Start += offset
+				subOp.End += offset
+			}
+		}
+
+		result.Ops = append(result.Ops, sub.Ops...)
+		offset += op.Len()
+	}
+
+	return &result, nil
+}
@@ -0,0 +1,68 @@
+package delta
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefinePatch(t *testing.T) {
+	a := testutil.RandomBytes(1, 1024)
+	b := append([]byte{}, a...)
+	b[100] ^= 0xff
+	b = append(b[:700], append([]byte("insert"), b[700:]...)...)
+
+	coarse := calculatePatch(t, 128, a, b)
+	assert.Equal(t, 256+6, literalBytes(coarse))
+
+	// first round: ask the basis holder for the fine signatures
+	refinements, err := Refinements(coarse, 16)
+	require.NoError(t, err)
+	require.Len(t, refinements, 2)
+	assert.Equal(t, 0, refinements[0].Start)
+	assert.Equal(t, 128, refinements[0].End)
+
+	// second round: diff the literals against the fine signatures
+	require.NoError(t, SignRefinements(bytes.NewReader(a), refinements))
+	refined, err := RefinePatch(coarse, refinements)
+	require.NoError(t, err)
+
+	assert.Equal(t, 16+16+6, literalBytes(refined))
+	assert.Equal(t, b, applyPatch(t, a, refined))
+
+	// the coarse patch is left untouched
+	assert.Equal(t, b, applyPatch(t, a, coarse))
+}
+
+func TestRefinePatchTail(t *testing.T) {
+	a := testutil.RandomBytes(2, 1000)
+	b := append(testutil.RandomBytes(3, 200), a[200:]...)
+	b[950] ^= 0xff
+
+	coarse := calculatePatch(t, 128, a, b)
+	refinements, err := Refinements(coarse, 16)
+	require.NoError(t, err)
+	require.NotEmpty(t, refinements)
+	assert.Equal(t, -1, refinements[len(refinements)-1].End)
+
+	require.NoError(t, SignRefinements(bytes.NewReader(a), refinements))
+	refined, err := RefinePatch(coarse, refinements)
+	require.NoError(t, err)
+
+	assert.Less(t, literalBytes(refined), literalBytes(coarse))
+	assert.Equal(t, b, applyPatch(t, a, refined))
+}
+
+func TestRefinePatchBadOp(t *testing.T) {
+	a := testutil.RandomBytes(4, 256)
+	coarse := calculatePatch(t, 128, a, a)
+
+	_, err := RefinePatch(coarse, []*Refinement{{Op: 0}})
+	assert.Error(t, err)
+
+	_, err = Refinements(coarse, 0)
+	assert.Error(t, err)
+}
@@ -1,6 +1,7 @@
 package delta
 
 import (
+	"crypto/sha256"
 	"errors"
 	"io"
 
@@ -70,3 +71,43 @@ func GenerateSignatures(target io.Reader, blockSize int) ([]*BlockSignature, err
 
 	return result, nil
 }
+
+// SignatureHash fingerprints the basis described by signatures.
+// It is the sha256 hash of the strong hashes of every block.
+func SignatureHash(signatures []*BlockSignature) []byte {
+	h := sha256.New()
+	for _, sig := range signatures {
+		h.Write(sig.Strong)
+	}
+
+	return h.Sum(nil)
+}
+
+// BasisHash calculates the fingerprint of the basis without keeping its blocks,
+// it is equal to the SignatureHash of the basis signatures
+func BasisHash(basis io.Reader, blockSize int) ([]byte, error) {
+	if blockSize == 0 {
+		return nil, errors.New("blockSize must be greater than 0")
+	}
+
+	h := sha256.New()
+	strongHasher := utils.NewHasher()
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadAtLeast(basis, block, blockSize)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+
+		h.Write(strongHasher.MakeHash(block[:n]))
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	return h.Sum(nil), nil
+}
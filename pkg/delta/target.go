@@ -0,0 +1,178 @@
+package delta
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/k1ng440/rolling-hash/pkg/rollsum"
+)
+
+// literalIndex indexes the blocks of literal data emitted so far, so repeated
+// content of the target can be copied from the target itself
+type literalIndex struct {
+	blocks map[uint32][]*literalBlock
+	weak   *rollsum.RollSum
+}
+
+type literalBlock struct {
+	offset int
+	data   []byte
+}
+
+func newLiteralIndex(blockSize int) *literalIndex {
+	return &literalIndex{
+		blocks: make(map[uint32][]*literalBlock),
+		weak:   rollsum.New(blockSize),
+	}
+}
+
+// add indexes a block of literal data written at the given target offset
+func (li *literalIndex) add(offset int, data []byte) {
+	li.weak.Reset()
+	li.weak.Write(data)
+	sum := li.weak.Sum32()
+
+	li.blocks[sum] = append(li.blocks[sum], &literalBlock{
+		offset: offset,
+		data:   data,
+	})
+}
+
+// match returns the target offset of a literal block equal to window, otherwise -1
+func (li *literalIndex) match(weakHash uint32, window []byte) int {
+	for _, block := range li.blocks[weakHash] {
+		if bytes.Equal(block.data, window) {
+			return block.offset
+		}
+	}
+
+	return -1
+}
+
+// targetIndex maps target offsets to the operations of a patch writing them
+type targetIndex struct {
+	patch   *Patch
+	offsets []int
+}
+
+func newTargetIndex(patch *Patch) *targetIndex {
+	offsets := make([]int, len(patch.Ops))
+	offset := 0
+	for i, op := range patch.Ops {
+		offsets[i] = offset
+		offset += op.Len()
+	}
+
+	return &targetIndex{
+		patch:   patch,
+		offsets: offsets,
+	}
+}
+
+// opAt returns the index of the operation writing the target byte at offset
+func (ti *targetIndex) opAt(offset int) (int, error) {
+	// last operation starting at or before offset
+	i := sort.Search(len(ti.offsets), func(i int) bool {
+		return ti.offsets[i] > offset
+	}) - 1
+	if i < 0 || offset >= ti.offsets[i]+ti.patch.Ops[i].Len() {
+		return 0, errors.New("offset is out of the patch target")
+	}
+
+	return i, nil
+}
+
+// readAt fills buf with the target bytes at offset, resolving them against the basis
+func (ti *targetIndex) readAt(basis io.ReaderAt, buf []byte, offset int) error {
+	for len(buf) > 0 {
+		i, err := ti.opAt(offset)
+		if err != nil {
+			return err
+		}
+
+		op := ti.patch.Ops[i]
+		skip := offset - ti.offsets[i]
+		n := minInt(len(buf), op.Len()-skip)
+
+		switch op.Type {
+		case OpLiteral:
+			copy(buf, op.Literal[skip:skip+n])
+
+		case OpCopy:
+			if basis == nil {
+				return errors.New("basis is required to read copied bytes")
+			}
+
+			// a full read may end with io.EOF at the end of the basis
+			if err := readFull(basis, buf[:n], op.Start+skip); err != nil {
+				return err
+			}
+
+		case OpRun:
+			for j := range buf[:n] {
+				buf[j] = op.Value
+			}
+
+		case OpCopyTarget:
+			if op.End > ti.offsets[i] {
+				return errTargetCopy
+			}
+
+			if err := ti.readAt(basis, buf[:n], op.Start+skip); err != nil {
+				return err
+			}
+
+		default:
+			return errUnknownOp
+		}
+
+		buf = buf[n:]
+		offset += n
+	}
+
+	return nil
+}
+
+// resolve calls emit with operations writing the target bytes from start to end,
+// copies of earlier target bytes are resolved to the operations they copy
+func (ti *targetIndex) resolve(start, end int, emit func(*Op)) error {
+	for start < end {
+		i, err := ti.opAt(start)
+		if err != nil {
+			return err
+		}
+
+		op := ti.patch.Ops[i]
+		skip := start - ti.offsets[i]
+		n := minInt(end-start, op.Len()-skip)
+
+		switch op.Type {
+		case OpLiteral:
+			emit(&Op{Type: OpLiteral, Literal: op.Literal[skip : skip+n]})
+
+		case OpCopy:
+			emit(&Op{Type: OpCopy, Start: op.Start + skip, End: op.Start + skip + n})
+
+		case OpRun:
+			emit(&Op{Type: OpRun, Value: op.Value, Count: n})
+
+		case OpCopyTarget:
+			if op.End > ti.offsets[i] {
+				return errTargetCopy
+			}
+
+			if err := ti.resolve(op.Start+skip, op.Start+skip+n, emit); err != nil {
+				return err
+			}
+
+		default:
+			return errUnknownOp
+		}
+
+		start += n
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package delta
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func countOps(patch *Patch, opType OpType) int {
+	n := 0
+	for _, op := range patch.Ops {
+		if op.Type == opType {
+			n++
+		}
+	}
+
+	return n
+}
+
+func TestPatchCopyTarget(t *testing.T) {
+	a := testutil.RandomBytes(1, 256)
+	x := testutil.RandomBytes(2, 48)
+
+	b := append([]byte{}, a[:64]...)
+	b = append(b, x...)
+	b = append(b, a[64:128]...)
+	b = append(b, x...)
+	b = append(b, a[128:]...)
+
+	patch := calculatePatch(t, 16, a, b)
+	assert.Equal(t, 3, countOps(patch, OpCopyTarget))
+	assert.Equal(t, len(x), literalBytes(patch))
+	assert.Equal(t, b, applyPatch(t, a, patch))
+}
+
+func TestPatchEmptyBasis(t *testing.T) {
+	x := testutil.RandomBytes(3, 64)
+	b := bytes.Repeat(x, 4)
+
+	// without a basis the patch only removes the repeated content
+	patch, err := GeneratePatch(bytes.NewReader(b), 16, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, countOps(patch, OpCopy))
+	assert.Equal(t, len(x), literalBytes(patch))
+	assert.Equal(t, b, applyPatch(t, nil, patch))
+
+	require.NoError(t, ExtendMatches(patch, bytes.NewReader(nil)))
+	assert.Len(t, patch.Ops, 4)
+	assert.Equal(t, b, applyPatch(t, nil, patch))
+}
+
+func TestDeltaRepeatedLiteral(t *testing.T) {
+	a := []byte("When summertime rolls in and the days get hot enough that you need to cool off from the blazing heat")
+	b := []byte("When summertime 0123456789abcdef0123456789abcdefrolls in and the days get hot enough that you need to cool off from the blazing heat")
+
+	// the map form holds repeated content as literal
+	_, delta := calculateDiff(t, 16, a, b)
+	assertDiff(t, map[int][]byte{
+		1: []byte("0123456789abcdef0123456789abcdef"),
+	}, delta)
+}
+
+func TestApplyBadTargetCopy(t *testing.T) {
+	patch := &Patch{
+		BlockSize: 16,
+		Ops: []*Op{
+			{Type: OpLiteral, Literal: []byte("abcd")},
+			{Type: OpCopyTarget, Start: 2, End: 6},
+		},
+	}
+
+	err := Apply(bytes.NewReader(nil), patch, new(bytes.Buffer))
+	assert.Error(t, err)
+}
+
+// eofReaderAt returns io.EOF with a full read ending at the end of its data,
+// as io.ReaderAt allows
+type eofReaderAt struct {
+	data []byte
+}
+
+func (r eofReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := bytes.NewReader(r.data).ReadAt(p, off)
+	if err == nil && off+int64(n) == int64(len(r.data)) {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+func TestTargetReadAtEOF(t *testing.T) {
+	a := testutil.RandomBytes(4, 256)
+	b := append(append([]byte{}, a[:128]...), a...)
+
+	patch := calculatePatch(t, 16, a, b)
+	basis := eofReaderAt{data: a}
+
+	r, err := NewPatchedReader(basis, patch)
+	require.NoError(t, err)
+	res, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, b, res)
+
+	// the basis really is too short
+	r, err = NewPatchedReader(eofReaderAt{data: a[:200]}, patch)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.ErrorIs(t, err, errShortBasis)
+}
@@ -0,0 +1,135 @@
+package delta
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/k1ng440/rolling-hash/pkg/internal/utils"
+)
+
+// BlockMismatchError is returned when basis blocks read by the patch changed
+// since their signatures were taken
+type BlockMismatchError struct {
+	// Blocks are the signature indexes of the changed blocks
+	Blocks []int
+	// Ranges are the target ranges that can not be rebuilt from the basis and
+	// need to be fetched in full
+	Ranges []Range
+}
+
+func (e *BlockMismatchError) Error() string {
+	return fmt.Sprintf("basis blocks %v changed since the signature was taken", e.Blocks)
+}
+
+// VerifyBlocks rehashes every basis block read by the copies of the patch and
+// checks it against the strong hash of its signature. It returns a
+// *BlockMismatchError listing the changed blocks and the affected target ranges.
+func VerifyBlocks(basis io.ReaderAt, patch *Patch, signatures []*BlockSignature) error {
+	if patch.BlockSize == 0 {
+		return fmt.Errorf("blockSize must be greater than 0")
+	}
+
+	v := &blockVerifier{
+		basis:      basis,
+		blockSize:  patch.BlockSize,
+		signatures: make(map[int]*BlockSignature),
+		checked:    make(map[int]bool),
+		hasher:     utils.NewHasher(),
+		block:      make([]byte, patch.BlockSize),
+	}
+	for _, sig := range signatures {
+		v.signatures[sig.Index] = sig
+	}
+
+	changed := make(map[int]bool)
+	ranges := make([]Range, 0)
+	offset := 0 // target offset of op
+	for _, op := range patch.Ops {
+		switch op.Type {
+		case OpCopy:
+			for index := op.Start / v.blockSize; index*v.blockSize < op.End; index++ {
+				ok, err := v.check(index)
+				if err != nil {
+					return err
+				}
+
+				if ok {
+					continue
+				}
+
+				changed[index] = true
+
+				// part of the copy reading the block
+				start := maxInt(index*v.blockSize, op.Start)
+				end := minInt((index+1)*v.blockSize, op.End)
+				ranges = append(ranges, Range{offset + start - op.Start, offset + end - op.Start})
+			}
+
+		case OpCopyTarget:
+			// earlier target bytes that can not be rebuilt
+			for _, r := range ranges {
+				start := maxInt(r.Start, op.Start)
+				end := minInt(r.End, op.End)
+				if start < end {
+					ranges = append(ranges, Range{offset + start - op.Start, offset + end - op.Start})
+				}
+			}
+		}
+
+		offset += op.Len()
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	blocks := make([]int, 0, len(changed))
+	for index := range changed {
+		blocks = append(blocks, index)
+	}
+	sort.Ints(blocks)
+	return &BlockMismatchError{
+		Blocks: blocks,
+		Ranges: coalesceRanges(ranges),
+	}
+}
+
+// blockVerifier checks basis blocks against their signatures, every block is read once
+type blockVerifier struct {
+	basis      io.ReaderAt
+	blockSize  int
+	signatures map[int]*BlockSignature
+	checked    map[int]bool
+	hasher     *utils.MD5Hasher
+	block      []byte
+}
+
+// check returns whether the block at index is equal to its signature
+func (v *blockVerifier) check(index int) (bool, error) {
+	if ok, done := v.checked[index]; done {
+		return ok, nil
+	}
+
+	sig, ok := v.signatures[index]
+	if ok {
+		n, err := v.basis.ReadAt(v.block, int64(index*v.blockSize))
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+
+		ok = bytes.Equal(v.hasher.MakeHash(v.block[:n]), sig.Strong)
+	}
+
+	v.checked[index] = ok
+	return ok, nil
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
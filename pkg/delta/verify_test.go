@@ -0,0 +1,78 @@
+package delta
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyBlocks(t *testing.T) {
+	a := testutil.RandomBytes(1, 256)
+	b := append(testutil.RandomBytes(2, 32), a...)
+
+	sigs, err := GenerateSignatures(bytes.NewReader(a), 16)
+	require.NoError(t, err)
+	patch, err := GeneratePatch(bytes.NewReader(b), 16, sigs)
+	require.NoError(t, err)
+
+	assert.NoError(t, VerifyBlocks(bytes.NewReader(a), patch, sigs))
+
+	// block 3 and 10 changed after the signature was taken
+	changed := append([]byte{}, a...)
+	changed[50] ^= 0xff
+	changed[170] ^= 0xff
+
+	err = VerifyBlocks(bytes.NewReader(changed), patch, sigs)
+	var mismatch *BlockMismatchError
+	require.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, []int{3, 10}, mismatch.Blocks)
+	assert.Equal(t, []Range{{80, 96}, {192, 208}}, mismatch.Ranges)
+}
+
+func TestVerifyBlocksCopyTarget(t *testing.T) {
+	a := testutil.RandomBytes(1, 64)
+	sigs, err := GenerateSignatures(bytes.NewReader(a), 16)
+	require.NoError(t, err)
+
+	patch := &Patch{
+		BlockSize: 16,
+		Ops: []*Op{
+			{Type: OpCopy, Start: 8, End: 40},
+			{Type: OpCopyTarget, Start: 0, End: 16},
+		},
+	}
+
+	changed := append([]byte{}, a...)
+	changed[10] ^= 0xff
+
+	// the target copy repeats bytes of the changed block
+	err = VerifyBlocks(bytes.NewReader(changed), patch, sigs)
+	var mismatch *BlockMismatchError
+	require.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, []int{0}, mismatch.Blocks)
+	assert.Equal(t, []Range{{0, 8}, {32, 40}}, mismatch.Ranges)
+}
+
+func TestVerifyBlocksMissingSignature(t *testing.T) {
+	a := testutil.RandomBytes(1, 64)
+	sigs, err := GenerateSignatures(bytes.NewReader(a), 16)
+	require.NoError(t, err)
+
+	patch := &Patch{
+		BlockSize: 16,
+		Ops:       []*Op{{Type: OpCopy, Start: 0, End: 32}},
+	}
+
+	err = VerifyBlocks(bytes.NewReader(a), patch, sigs[1:])
+	var mismatch *BlockMismatchError
+	require.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, []int{0}, mismatch.Blocks)
+}
+
+func TestCoalesceRanges(t *testing.T) {
+	ranges := coalesceRanges([]Range{{10, 20}, {0, 5}, {5, 8}, {15, 30}, {40, 40}})
+	assert.Equal(t, []Range{{0, 8}, {10, 30}}, ranges)
+}
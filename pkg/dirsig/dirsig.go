@@ -0,0 +1,361 @@
+// Package dirsig writes signature manifests of directory trees. A manifest holds
+// the metadata and block signatures of every file and a Merkle tree over the
+// blocks, files and directories, so two replicas are compared by their root hash
+// and narrowed down to the differing files and blocks without reading any data.
+package dirsig
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/k1ng440/rolling-hash/pkg/chunkstore"
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/k1ng440/rolling-hash/pkg/files"
+	"github.com/k1ng440/rolling-hash/pkg/internal/utils"
+)
+
+// manifestVersion is the version of the manifest file format
+const manifestVersion = 1
+
+// prefixes of the hashed nodes, a hash of one kind never equals a hash of another
+const (
+	blockPrefix byte = iota
+	innerPrefix
+	filePrefix
+	dirPrefix
+)
+
+// Node is a file, directory or symlink of a manifest
+type Node struct {
+	// Name is the base name of the node, empty for the root
+	Name    string
+	Mode    os.FileMode
+	ModTime time.Time
+	Size    int64
+	// Link is the target of a symlink
+	Link string
+	// Blocks are the signatures of the blocks of a regular file, without block data
+	Blocks []*delta.BlockSignature
+	// BlockHashes are the leaves of the Merkle tree of a regular file
+	BlockHashes [][]byte
+	// Children of a directory, sorted by name
+	Children []*Node
+	// Hash covers the name, type, permissions, size, link and content of the
+	// children or blocks. Modification times are not part of the hash.
+	Hash []byte
+}
+
+// Manifest is the signature of a directory tree
+type Manifest struct {
+	Version   int
+	BlockSize int
+	Root      *Node
+}
+
+// Build walks the tree at root and returns its manifest
+func Build(root string, blockSize int) (*Manifest, error) {
+	if blockSize <= 0 {
+		return nil, errors.New("blockSize must be greater than 0")
+	}
+
+	info, err := os.Lstat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	node, err := buildNode(root, info, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	node.Name = ""
+
+	return &Manifest{
+		Version:   manifestVersion,
+		BlockSize: blockSize,
+		Root:      node,
+	}, nil
+}
+
+func buildNode(path string, info os.FileInfo, blockSize int) (*Node, error) {
+	node := &Node{
+		Name:    info.Name(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+	}
+
+	switch {
+	case info.IsDir():
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		// ReadDir sorts the entries by name
+		for _, entry := range entries {
+			if !entry.IsDir() && !entry.Mode().IsRegular() && entry.Mode()&os.ModeSymlink == 0 {
+				// devices, sockets and pipes have no signature
+				continue
+			}
+
+			child, err := buildNode(filepath.Join(path, entry.Name()), entry, blockSize)
+			if err != nil {
+				return nil, err
+			}
+			node.Children = append(node.Children, child)
+		}
+
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		node.Link = link
+
+	default:
+		if err := signFile(path, node, blockSize); err != nil {
+			return nil, err
+		}
+	}
+
+	node.Hash = node.hash()
+	return node, nil
+}
+
+// signFile computes the block signatures and block hashes of a regular file
+func signFile(path string, node *Node, blockSize int) error {
+	fi, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	chunker := &chunkstore.FixedChunker{BlockSize: blockSize}
+	return chunker.Signatures(fi, func(sig *delta.BlockSignature) error {
+		node.BlockHashes = append(node.BlockHashes, blockHash(sig.BlockData))
+		node.Size += int64(len(sig.BlockData))
+
+		sig.BlockData = nil
+		node.Blocks = append(node.Blocks, sig)
+		return nil
+	})
+}
+
+func blockHash(block []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{blockPrefix})
+	h.Write(block)
+	return h.Sum(nil)
+}
+
+// merkleRoot returns the root of the binary Merkle tree over the leaves, an
+// odd node is carried to the next level. Zero leaves give a zero hash.
+func merkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return make([]byte, sha256.Size)
+	}
+
+	level := leaves
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				break
+			}
+
+			h := sha256.New()
+			h.Write([]byte{innerPrefix})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+
+	return level[0]
+}
+
+// hash computes the hash of the node from its metadata and the hashes of its
+// children or blocks
+func (n *Node) hash() []byte {
+	h := sha256.New()
+	var buf [8]byte
+
+	if n.Mode.IsDir() {
+		h.Write([]byte{dirPrefix})
+		binary.BigEndian.PutUint32(buf[:4], uint32(n.Mode))
+		h.Write(buf[:4])
+
+		for _, child := range n.Children {
+			binary.BigEndian.PutUint64(buf[:], uint64(len(child.Name)))
+			h.Write(buf[:])
+			h.Write([]byte(child.Name))
+			h.Write(child.Hash)
+		}
+
+		return h.Sum(nil)
+	}
+
+	h.Write([]byte{filePrefix})
+	binary.BigEndian.PutUint32(buf[:4], uint32(n.Mode))
+	h.Write(buf[:4])
+	binary.BigEndian.PutUint64(buf[:], uint64(n.Size))
+	h.Write(buf[:])
+	binary.BigEndian.PutUint64(buf[:], uint64(len(n.Link)))
+	h.Write(buf[:])
+	h.Write([]byte(n.Link))
+	h.Write(merkleRoot(n.BlockHashes))
+
+	return h.Sum(nil)
+}
+
+// verify recomputes the hashes of the tree under n
+func (n *Node) verify() error {
+	if len(n.Blocks) != len(n.BlockHashes) {
+		return fmt.Errorf("%s: invalid block list", n.Name)
+	}
+
+	for i, child := range n.Children {
+		if i > 0 && n.Children[i-1].Name >= child.Name {
+			return fmt.Errorf("%s: children are not sorted", n.Name)
+		}
+
+		if err := child.verify(); err != nil {
+			return err
+		}
+	}
+
+	if !bytes.Equal(n.hash(), n.Hash) {
+		return fmt.Errorf("%s: hash does not match the content", n.Name)
+	}
+
+	return nil
+}
+
+// RootHash returns the hash of the whole tree
+func (m *Manifest) RootHash() []byte {
+	return m.Root.Hash
+}
+
+// Write writes the manifest to a file
+func (m *Manifest) Write(filename string) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(m); err != nil {
+		return err
+	}
+
+	return files.WriteFile(filename, buf)
+}
+
+// Read reads a manifest written by Write and checks its hashes
+func Read(filename string) (*Manifest, error) {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	m := &Manifest{}
+	if err := gob.NewDecoder(fi).Decode(m); err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+
+	if m.Version != manifestVersion || m.Root == nil || !m.Root.Mode.IsDir() {
+		return nil, errors.New("invalid manifest file")
+	}
+
+	if err := m.Root.verify(); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	return m, nil
+}
+
+// ChangeKind is the kind of difference of a path between two manifests
+type ChangeKind = utils.ChangeKind
+
+const (
+	Added    = utils.Added
+	Removed  = utils.Removed
+	Modified = utils.Modified
+)
+
+// Difference is a path differing between two manifests
+type Difference struct {
+	// Path is relative to the root, slash separated
+	Path string
+	Kind ChangeKind
+	// Blocks are the indexes of the differing blocks of a modified file,
+	// in the file of the second manifest
+	Blocks []int
+}
+
+// Compare returns the differences from a to b, sorted by path. Subtrees with
+// the same hash are skipped, so two identical trees only compare their roots.
+func Compare(a, b *Manifest) ([]*Difference, error) {
+	if a.BlockSize != b.BlockSize {
+		return nil, errors.New("manifests have different block sizes")
+	}
+
+	diffs := make([]*Difference, 0)
+	compareNodes(a.Root, b.Root, "", &diffs)
+	return diffs, nil
+}
+
+func compareNodes(a, b *Node, path string, diffs *[]*Difference) {
+	if bytes.Equal(a.Hash, b.Hash) {
+		return
+	}
+
+	if !a.Mode.IsDir() || !b.Mode.IsDir() {
+		*diffs = append(*diffs, &Difference{
+			Path:   path,
+			Kind:   Modified,
+			Blocks: differingBlocks(a, b),
+		})
+		return
+	}
+
+	// both children lists are sorted by name
+	i, j := 0, 0
+	for i < len(a.Children) || j < len(b.Children) {
+		switch {
+		case j == len(b.Children) || (i < len(a.Children) && a.Children[i].Name < b.Children[j].Name):
+			*diffs = append(*diffs, &Difference{Path: utils.JoinPath(path, a.Children[i].Name), Kind: Removed})
+			i++
+
+		case i == len(a.Children) || a.Children[i].Name > b.Children[j].Name:
+			*diffs = append(*diffs, &Difference{Path: utils.JoinPath(path, b.Children[j].Name), Kind: Added})
+			j++
+
+		default:
+			compareNodes(a.Children[i], b.Children[j], utils.JoinPath(path, a.Children[i].Name), diffs)
+			i++
+			j++
+		}
+	}
+}
+
+// differingBlocks returns the blocks of b differing from the block at the same index in a
+func differingBlocks(a, b *Node) []int {
+	blocks := make([]int, 0)
+	for i, h := range b.BlockHashes {
+		if i >= len(a.BlockHashes) || !bytes.Equal(a.BlockHashes[i], h) {
+			blocks = append(blocks, i)
+		}
+	}
+
+	return blocks
+}
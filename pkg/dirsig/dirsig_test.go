@@ -0,0 +1,141 @@
+package dirsig
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/k1ng440/rolling-hash/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testBlockSize = 1024
+
+// replicas returns two identical trees
+func replicas(t *testing.T) (string, string, []byte) {
+	big := testutil.RandomBytes(1, 100*testBlockSize+10)
+
+	a := filepath.Join(t.TempDir(), "a")
+	b := filepath.Join(t.TempDir(), "b")
+	for _, root := range []string{a, b} {
+		testutil.WriteFile(t, filepath.Join(root, "big.bin"), big)
+		testutil.WriteFile(t, filepath.Join(root, "dir/sub/file.txt"), []byte("hello"))
+		testutil.WriteFile(t, filepath.Join(root, "dir/other.txt"), []byte("other"))
+		testutil.WriteFile(t, filepath.Join(root, "empty"), nil)
+		require.NoError(t, os.Symlink("dir/sub/file.txt", filepath.Join(root, "link")))
+	}
+
+	return a, b, big
+}
+
+func build(t *testing.T, root string) *Manifest {
+	m, err := Build(root, testBlockSize)
+	require.NoError(t, err)
+	return m
+}
+
+func TestBuild(t *testing.T) {
+	a, b, big := replicas(t)
+
+	// modification times are not compared
+	mtime := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(b, "big.bin"), mtime, mtime))
+
+	ma, mb := build(t, a), build(t, b)
+	assert.Equal(t, ma.RootHash(), mb.RootHash())
+
+	diffs, err := Compare(ma, mb)
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+
+	var file *Node
+	for _, child := range ma.Root.Children {
+		if child.Name == "big.bin" {
+			file = child
+		}
+	}
+	require.NotNil(t, file)
+	assert.Equal(t, int64(len(big)), file.Size)
+	assert.Len(t, file.Blocks, 101)
+	assert.Len(t, file.BlockHashes, 101)
+	for i, block := range file.Blocks {
+		assert.Equal(t, i, block.Index)
+		assert.Nil(t, block.BlockData)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	a, b, big := replicas(t)
+
+	edited := append([]byte{}, big...)
+	edited[5*testBlockSize+1] ^= 0xff
+	edited[50*testBlockSize] ^= 0xff
+	testutil.WriteFile(t, filepath.Join(b, "big.bin"), edited)
+	testutil.WriteFile(t, filepath.Join(b, "dir/new.txt"), []byte("new"))
+	require.NoError(t, os.Remove(filepath.Join(b, "dir/other.txt")))
+	require.NoError(t, os.Chmod(filepath.Join(b, "empty"), 0600))
+	require.NoError(t, os.Remove(filepath.Join(b, "link")))
+	require.NoError(t, os.Symlink("big.bin", filepath.Join(b, "link")))
+
+	ma, mb := build(t, a), build(t, b)
+	assert.NotEqual(t, ma.RootHash(), mb.RootHash())
+
+	diffs, err := Compare(ma, mb)
+	require.NoError(t, err)
+	assert.Equal(t, []*Difference{
+		{Path: "big.bin", Kind: Modified, Blocks: []int{5, 50}},
+		{Path: "dir/new.txt", Kind: Added},
+		{Path: "dir/other.txt", Kind: Removed},
+		{Path: "empty", Kind: Modified, Blocks: []int{}},
+		{Path: "link", Kind: Modified, Blocks: []int{}},
+	}, diffs)
+
+	// the unchanged subtree is skipped
+	for _, diff := range diffs {
+		assert.NotEqual(t, "dir/sub/file.txt", diff.Path)
+	}
+
+	other, err := Build(a, 2*testBlockSize)
+	require.NoError(t, err)
+	_, err = Compare(ma, other)
+	assert.Error(t, err)
+}
+
+func TestManifestFile(t *testing.T) {
+	a, _, _ := replicas(t)
+	m := build(t, a)
+
+	filename := filepath.Join(t.TempDir(), "tree.sig")
+	require.NoError(t, m.Write(filename))
+
+	read, err := Read(filename)
+	require.NoError(t, err)
+	assert.Equal(t, m.RootHash(), read.RootHash())
+
+	diffs, err := Compare(m, read)
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+
+	// a block hash changed without updating the tree is detected
+	for _, child := range m.Root.Children {
+		if child.Name == "big.bin" {
+			child.BlockHashes[3][0] ^= 0xff
+		}
+	}
+	require.NoError(t, m.Write(filename))
+	_, err = Read(filename)
+	assert.Error(t, err)
+}
+
+func TestBuildNotDirectory(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "file")
+	testutil.WriteFile(t, filename, []byte("data"))
+
+	_, err := Build(filename, testBlockSize)
+	assert.Error(t, err)
+
+	_, err = Build(t.TempDir(), 0)
+	assert.Error(t, err)
+}
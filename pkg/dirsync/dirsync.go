@@ -0,0 +1,299 @@
+// Package dirsync makes a local directory tree match another one. Changed files
+// are rebuilt rsync-style from the signatures of the destination file and the
+// delta of the source file.
+package dirsync
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/k1ng440/rolling-hash/pkg/files"
+	"github.com/k1ng440/rolling-hash/pkg/internal/utils"
+)
+
+// Options controls a synchronization
+type Options struct {
+	// Checksum compares the content of files instead of their size and modification time
+	Checksum bool
+	// BlockSize of the signatures, delta.DefaultBlockSize when zero
+	BlockSize int
+}
+
+// Stats summarizes a synchronization
+type Stats struct {
+	// Files is the number of regular files in the source tree
+	Files     int
+	Unchanged int
+	Created   int
+	Patched   int
+	// Deleted counts the entries of the destination missing from the source, a
+	// directory counts once with its content
+	Deleted int
+	// Literal is the number of bytes of the source files not found in the destination files
+	Literal int64
+	// Matched is the number of bytes of the patched files copied from their old version
+	Matched int64
+}
+
+// Sync updates the tree at dst to match the tree at src. Regular files,
+// directories and symlinks are synchronized, other files are ignored. Entries of
+// dst missing from src are deleted.
+func Sync(src, dst string, opts *Options) (*Stats, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	blockSize := opts.BlockSize
+	if blockSize == 0 {
+		blockSize = delta.DefaultBlockSize
+	}
+
+	srcEntries, err := walk(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return nil, err
+	}
+
+	dstEntries, err := walk(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{}
+	if err := deleteExtra(dst, srcEntries, dstEntries, stats); err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(srcEntries))
+	for p := range srcEntries {
+		paths = append(paths, p)
+	}
+	// parents sort before their content
+	sort.Strings(paths)
+
+	dirs := make([]string, 0)
+	for _, p := range paths {
+		info := srcEntries[p]
+		srcPath := filepath.Join(src, p)
+		dstPath := filepath.Join(dst, p)
+
+		switch utils.FileKind(info.Mode()) {
+		case os.ModeDir:
+			// writable until the content is synchronized
+			if _, ok := dstEntries[p]; !ok {
+				if err := os.Mkdir(dstPath, 0700); err != nil {
+					return nil, err
+				}
+			} else if err := os.Chmod(dstPath, 0700); err != nil {
+				return nil, err
+			}
+			dirs = append(dirs, p)
+
+		case os.ModeSymlink:
+			if err := syncLink(srcPath, dstPath, dstEntries[p]); err != nil {
+				return nil, err
+			}
+
+		case 0:
+			stats.Files++
+			if err := syncFile(srcPath, dstPath, info, dstEntries[p], blockSize, opts.Checksum, stats); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// deepest first, setting the time of a directory after its content
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := syncMetadata(filepath.Join(dst, dirs[i]), srcEntries[dirs[i]]); err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+// walk returns the entries under root by relative path, root excluded
+func walk(root string) (map[string]os.FileInfo, error) {
+	entries := make(map[string]os.FileInfo)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		entries[rel] = info
+		return nil
+	})
+
+	return entries, err
+}
+
+// deleteExtra removes the entries of dst missing from src or of another kind
+func deleteExtra(dst string, srcEntries, dstEntries map[string]os.FileInfo, stats *Stats) error {
+	extra := make([]string, 0)
+	for p, info := range dstEntries {
+		if srcInfo, ok := srcEntries[p]; !ok || utils.FileKind(srcInfo.Mode()) != utils.FileKind(info.Mode()) {
+			extra = append(extra, p)
+		}
+	}
+	sort.Strings(extra)
+
+	removed := make(map[string]bool)
+	for _, p := range extra {
+		delete(dstEntries, p)
+
+		// the content of a removed directory is already gone
+		if removedParent(p, removed) {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(dst, p)); err != nil {
+			return err
+		}
+
+		removed[p] = true
+		stats.Deleted++
+	}
+
+	return nil
+}
+
+func removedParent(p string, removed map[string]bool) bool {
+	for dir := filepath.Dir(p); dir != "."; dir = filepath.Dir(dir) {
+		if removed[dir] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func syncLink(srcPath, dstPath string, dstInfo os.FileInfo) error {
+	target, err := os.Readlink(srcPath)
+	if err != nil {
+		return err
+	}
+
+	if dstInfo != nil {
+		current, err := os.Readlink(dstPath)
+		if err == nil && current == target {
+			return nil
+		}
+
+		if err := os.Remove(dstPath); err != nil {
+			return err
+		}
+	}
+
+	return os.Symlink(target, dstPath)
+}
+
+// syncFile creates or patches the destination file and copies the metadata of the source file
+func syncFile(srcPath, dstPath string, info, dstInfo os.FileInfo, blockSize int, checksum bool, stats *Stats) error {
+	switch {
+	case dstInfo == nil:
+		fi, err := os.Open(srcPath)
+		if err != nil {
+			return err
+		}
+		defer fi.Close()
+
+		if err := files.WriteFile(dstPath, fi); err != nil {
+			return err
+		}
+
+		stats.Created++
+		stats.Literal += info.Size()
+
+	case unchanged(srcPath, dstPath, info, dstInfo, checksum):
+		stats.Unchanged++
+		if dstInfo.Mode() == info.Mode() && dstInfo.ModTime().Equal(info.ModTime()) {
+			return nil
+		}
+
+	default:
+		if err := patchFile(srcPath, dstPath, blockSize, stats); err != nil {
+			return err
+		}
+		stats.Patched++
+	}
+
+	return syncMetadata(dstPath, info)
+}
+
+// unchanged reports whether the destination file has the content of the source file
+func unchanged(srcPath, dstPath string, info, dstInfo os.FileInfo, checksum bool) bool {
+	if info.Size() != dstInfo.Size() {
+		return false
+	}
+
+	if !checksum {
+		return info.ModTime().Equal(dstInfo.ModTime())
+	}
+
+	srcSum, err := utils.HashFile(srcPath)
+	if err != nil {
+		return false
+	}
+
+	dstSum, err := utils.HashFile(dstPath)
+	return err == nil && bytes.Equal(srcSum, dstSum)
+}
+
+// patchFile rebuilds the destination file from its signatures and the delta of the source file
+func patchFile(srcPath, dstPath string, blockSize int, stats *Stats) error {
+	basis, err := os.Open(dstPath)
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+
+	sigs, err := delta.GenerateSignatures(basis, blockSize)
+	if err != nil {
+		return err
+	}
+
+	target, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	patch, err := delta.GeneratePatchWithBasis(target, blockSize, sigs, basis)
+	if err != nil {
+		return err
+	}
+
+	matched := int64(0)
+	for _, op := range patch.Ops {
+		if op.Type == delta.OpCopy {
+			matched += int64(op.Len())
+		}
+	}
+	stats.Matched += matched
+	stats.Literal += int64(patch.Size()) - matched
+
+	return files.PatchFile(dstPath, basis, patch)
+}
+
+func syncMetadata(path string, info os.FileInfo) error {
+	if err := os.Chmod(path, info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,109 @@
+package dirsync
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/k1ng440/rolling-hash/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSync(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	big := make([]byte, 256*1024)
+	rnd.Read(big)
+
+	src := filepath.Join(t.TempDir(), "src")
+	dst := filepath.Join(t.TempDir(), "dst")
+
+	testutil.WriteFile(t, filepath.Join(src, "big.bin"), big)
+	testutil.WriteFile(t, filepath.Join(src, "dir/sub/file.txt"), []byte("hello"))
+	testutil.WriteFile(t, filepath.Join(src, "empty"), nil)
+	require.NoError(t, os.Symlink("dir/sub/file.txt", filepath.Join(src, "link")))
+	require.NoError(t, os.Chmod(filepath.Join(src, "dir"), 0750))
+
+	stats, err := Sync(src, dst, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.Created)
+	assert.Equal(t, testutil.Snapshot(t, src, false), testutil.Snapshot(t, dst, false))
+
+	// change, add and delete files, turn a file into a directory and move the link
+	edited := append(append(append([]byte{}, big[:100000]...), []byte("inserted")...), big[100000:]...)
+	testutil.WriteFile(t, filepath.Join(src, "big.bin"), edited)
+	testutil.WriteFile(t, filepath.Join(src, "new.txt"), []byte("new"))
+	require.NoError(t, os.RemoveAll(filepath.Join(src, "dir/sub")))
+	require.NoError(t, os.Remove(filepath.Join(src, "empty")))
+	testutil.WriteFile(t, filepath.Join(src, "empty/inside"), []byte("inside"))
+	require.NoError(t, os.Remove(filepath.Join(src, "link")))
+	require.NoError(t, os.Symlink("new.txt", filepath.Join(src, "link")))
+
+	stats, err = Sync(src, dst, nil)
+	require.NoError(t, err)
+	assert.Equal(t, testutil.Snapshot(t, src, false), testutil.Snapshot(t, dst, false))
+	assert.Equal(t, 1, stats.Patched)
+	assert.Equal(t, 2, stats.Created)
+	// dir/sub with its content and the file replaced by a directory, the link is replaced in place
+	assert.Equal(t, 2, stats.Deleted)
+	assert.Less(t, stats.Literal, int64(16*1024), "only the blocks around the insertion are sent")
+	assert.Greater(t, stats.Matched, int64(200*1024))
+
+	stats, err = Sync(src, dst, nil)
+	require.NoError(t, err)
+	assert.Equal(t, stats.Files, stats.Unchanged)
+	assert.Zero(t, stats.Literal)
+}
+
+func TestSyncChecksum(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	dst := filepath.Join(t.TempDir(), "dst")
+
+	testutil.WriteFile(t, filepath.Join(src, "file"), []byte("version 1"))
+	_, err := Sync(src, dst, nil)
+	require.NoError(t, err)
+
+	// same size and time, only the content tells the change
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	testutil.WriteFile(t, filepath.Join(src, "file"), []byte("version 2"))
+	require.NoError(t, os.Chtimes(filepath.Join(src, "file"), mtime, mtime))
+	require.NoError(t, os.Chtimes(filepath.Join(dst, "file"), mtime, mtime))
+
+	stats, err := Sync(src, dst, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Unchanged)
+
+	stats, err = Sync(src, dst, &Options{Checksum: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Patched)
+	assert.Equal(t, testutil.Snapshot(t, src, false), testutil.Snapshot(t, dst, false))
+
+	stats, err = Sync(src, dst, &Options{Checksum: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Unchanged)
+}
+
+func TestSyncReadOnly(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	dst := filepath.Join(t.TempDir(), "dst")
+
+	testutil.WriteFile(t, filepath.Join(src, "ro/file"), []byte("one"))
+	require.NoError(t, os.Chmod(filepath.Join(src, "ro/file"), 0444))
+	require.NoError(t, os.Chmod(filepath.Join(src, "ro"), 0555))
+	defer os.Chmod(filepath.Join(src, "ro"), 0755)
+	defer os.Chmod(filepath.Join(dst, "ro"), 0755)
+
+	_, err := Sync(src, dst, nil)
+	require.NoError(t, err)
+
+	// the read-only directory of the destination is updated too
+	require.NoError(t, os.Chmod(filepath.Join(src, "ro"), 0755))
+	testutil.WriteFile(t, filepath.Join(src, "ro/other"), []byte("two"))
+	require.NoError(t, os.Chmod(filepath.Join(src, "ro"), 0555))
+
+	_, err = Sync(src, dst, nil)
+	require.NoError(t, err)
+	assert.Equal(t, testutil.Snapshot(t, src, false), testutil.Snapshot(t, dst, false))
+}
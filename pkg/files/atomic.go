@@ -0,0 +1,73 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// DefaultFileMode is the permission of the files written by this package
+// unless another one is given
+const DefaultFileMode os.FileMode = 0644
+
+// atomicFile is written under a temporary name in the directory of the final
+// file and renamed over it once complete, so a crash never leaves a partially
+// written file under the final name
+type atomicFile struct {
+	*os.File
+	filename string
+	done     bool
+}
+
+// createAtomic creates the temporary file of filename with the given
+// permission, DefaultFileMode when zero
+func createAtomic(filename string, mode os.FileMode) (*atomicFile, error) {
+	if mode == 0 {
+		mode = DefaultFileMode
+	}
+
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+
+	fi, err := os.CreateTemp(dir, "."+base+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fi.Chmod(mode); err != nil {
+		fi.Close()
+		os.Remove(fi.Name())
+		return nil, err
+	}
+
+	return &atomicFile{File: fi, filename: filename}, nil
+}
+
+// commit flushes the file to disk and renames it to its final name
+func (f *atomicFile) commit() error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), f.filename); err != nil {
+		return err
+	}
+
+	f.done = true
+	return syncDir(filepath.Dir(f.filename))
+}
+
+// abort removes the temporary file unless it has been committed
+func (f *atomicFile) abort() {
+	if f.done {
+		return
+	}
+
+	f.Close()
+	os.Remove(f.Name())
+}
@@ -0,0 +1,75 @@
+package files
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritePatchTruncates(t *testing.T) {
+	deltaPath := path.Join(t.TempDir(), "signature.delta")
+
+	long := &delta.Patch{BlockSize: 16}
+	long.Ops = append(long.Ops, &delta.Op{Type: delta.OpLiteral, Literal: make([]byte, 4096)})
+	assert.NoError(t, WritePatch(deltaPath, long))
+
+	short := &delta.Patch{BlockSize: 16}
+	short.Ops = append(short.Ops, &delta.Op{Type: delta.OpCopy, Start: 0, End: 16})
+	assert.NoError(t, WritePatch(deltaPath, short))
+
+	res, err := ReadDelta(deltaPath)
+	assert.NoError(t, err)
+	assert.Equal(t, short, res)
+}
+
+func TestAtomicFileMode(t *testing.T) {
+	deltaPath := path.Join(t.TempDir(), "signature.delta")
+	assert.NoError(t, WriteDeltaWithOptions(deltaPath, &delta.Patch{}, &DeltaOptions{Mode: 0600}))
+
+	info, err := os.Stat(deltaPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// without a mode the default is used
+	assert.NoError(t, WritePatch(deltaPath, &delta.Patch{}))
+
+	info, err = os.Stat(deltaPath)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultFileMode, info.Mode().Perm())
+
+	newPath := path.Join(t.TempDir(), "new-file")
+	for _, opts := range []*PatchOptions{{Mode: 0600}, {Mode: 0600, Workers: 2}, {Mode: 0600, Resumable: true}} {
+		assert.NoError(t, PatchFileWithOptions(newPath, bytes.NewReader(nil), &delta.Patch{}, opts))
+
+		info, err = os.Stat(newPath)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		assert.NoError(t, os.Remove(newPath))
+	}
+}
+
+func TestAtomicFileFailure(t *testing.T) {
+	dir := t.TempDir()
+	newPath := path.Join(dir, "new-file")
+	assert.NoError(t, ioutil.WriteFile(newPath, []byte("previous"), 0644))
+
+	// the basis is too short for the copy
+	patch := &delta.Patch{BlockSize: 16}
+	patch.Ops = append(patch.Ops, &delta.Op{Type: delta.OpCopy, Start: 0, End: 16})
+	err := PatchFile(newPath, bytes.NewReader([]byte("short")), patch)
+	assert.Error(t, err)
+
+	// the previous file is untouched and no temporary file is left
+	res, err := ioutil.ReadFile(newPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "previous", string(res))
+
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
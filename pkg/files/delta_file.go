@@ -0,0 +1,327 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+)
+
+// deltaVersion is the version of the delta file format
+const deltaVersion = 1
+
+// dictionarySize is the number of basis bytes used to prime a literal dictionary, the flate window size
+const dictionarySize = 32 * 1024
+
+// ErrBasisRequired is returned when decoding a delta compressed with a basis dictionary without the basis
+var ErrBasisRequired = errors.New("the delta needs the basis to decompress literals")
+
+// Compression is the algorithm used to compress the literals of a delta file
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionFlate
+	CompressionZlib
+	CompressionGzip
+)
+
+var compressionNames = map[Compression]string{
+	CompressionNone:  "none",
+	CompressionFlate: "flate",
+	CompressionZlib:  "zlib",
+	CompressionGzip:  "gzip",
+}
+
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("compression(%d)", uint8(c))
+}
+
+// ParseCompression returns the compression with the given name
+func ParseCompression(name string) (Compression, error) {
+	for c, n := range compressionNames {
+		if strings.EqualFold(n, name) {
+			return c, nil
+		}
+	}
+
+	return CompressionNone, fmt.Errorf("unknown compression %q", name)
+}
+
+// DeltaHeader is written at the start of every delta file
+type DeltaHeader struct {
+	Version     int
+	Compression Compression
+	// PerLiteral compresses every literal on its own instead of the whole patch
+	PerLiteral bool
+	// Dictionary primes every literal with the basis bytes following the preceding copy
+	Dictionary bool
+}
+
+// DeltaOptions controls the encoding of a delta file
+type DeltaOptions struct {
+	Compression Compression
+	PerLiteral  bool
+	// Basis enables the flate dictionary of per literal compression when set
+	Basis io.ReaderAt
+	// Key encrypts the file when set, see NewEncryptWriter
+	Key *Key
+	// Mode is the permission of the file written by WriteDeltaWithOptions, DefaultFileMode when zero
+	Mode os.FileMode
+}
+
+// EncodeDelta writes the header and the patch to w
+func EncodeDelta(w io.Writer, patch *delta.Patch, opts *DeltaOptions) error {
+	if opts == nil {
+		opts = &DeltaOptions{}
+	}
+
+	header := &DeltaHeader{
+		Version:     deltaVersion,
+		Compression: opts.Compression,
+		PerLiteral:  opts.PerLiteral,
+		Dictionary:  opts.Basis != nil,
+	}
+
+	if header.Dictionary && (!header.PerLiteral || header.Compression != CompressionFlate) {
+		return errors.New("basis dictionary requires per literal flate compression")
+	}
+
+	g := gob.NewEncoder(w)
+	if err := g.Encode(header); err != nil {
+		return err
+	}
+
+	if header.Compression == CompressionNone {
+		return g.Encode(patch)
+	}
+
+	if header.PerLiteral {
+		compressed, err := transformLiterals(patch, opts.Basis, func(op *delta.Op, dict []byte) (*delta.Op, error) {
+			literal, err := compress(op.Literal, header.Compression, dict)
+			if err != nil {
+				return nil, err
+			}
+
+			// the size bounds the decompression of the literal
+			return &delta.Op{Type: delta.OpLiteral, Literal: literal, Count: len(op.Literal)}, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return g.Encode(compressed)
+	}
+
+	cw, err := newCompressor(w, header.Compression, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := gob.NewEncoder(cw).Encode(patch); err != nil {
+		return err
+	}
+
+	return cw.Close()
+}
+
+// DecodeDelta reads a patch written by EncodeDelta from r.
+// The basis is only needed by deltas compressed with a basis dictionary.
+func DecodeDelta(r io.Reader, basis io.ReaderAt) (*DeltaHeader, *delta.Patch, error) {
+	// gob does not read ahead of the header from an io.ByteReader
+	br := asByteReader(r)
+
+	header := &DeltaHeader{}
+	g := gob.NewDecoder(br)
+	if err := g.Decode(header); err != nil {
+		return nil, nil, err
+	}
+
+	if header.Version != deltaVersion {
+		return nil, nil, fmt.Errorf("unsupported delta version %d", header.Version)
+	}
+
+	if header.Dictionary && basis == nil {
+		return nil, nil, ErrBasisRequired
+	}
+
+	patch := &delta.Patch{}
+	if header.Compression == CompressionNone || header.PerLiteral {
+		if err := g.Decode(patch); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		cr, err := newDecompressor(br, header.Compression, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer cr.Close()
+
+		if err := gob.NewDecoder(cr).Decode(patch); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := patch.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	if header.Compression == CompressionNone || !header.PerLiteral {
+		return header, patch, nil
+	}
+
+	if !header.Dictionary {
+		basis = nil
+	}
+
+	patch, err := transformLiterals(patch, basis, func(op *delta.Op, dict []byte) (*delta.Op, error) {
+		literal, err := decompress(op.Literal, header.Compression, dict, op.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		return &delta.Op{Type: delta.OpLiteral, Literal: literal}, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return header, patch, nil
+}
+
+// transformLiterals returns a copy of the patch with every literal replaced by fn.
+// When basis is set, fn also gets the basis bytes following the preceding copy.
+func transformLiterals(patch *delta.Patch, basis io.ReaderAt, fn func(op *delta.Op, dict []byte) (*delta.Op, error)) (*delta.Patch, error) {
+	result := *patch
+	result.Ops = nil
+	prevEnd := 0
+	for _, op := range patch.Ops {
+		if op.Type == delta.OpCopy {
+			prevEnd = op.End
+		}
+
+		if op.Type != delta.OpLiteral {
+			result.Ops = append(result.Ops, op)
+			continue
+		}
+
+		var dict []byte
+		if basis != nil {
+			var err error
+			if dict, err = readDictionary(basis, prevEnd); err != nil {
+				return nil, err
+			}
+		}
+
+		literal, err := fn(op, dict)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Ops = append(result.Ops, literal)
+	}
+
+	return &result, nil
+}
+
+// readDictionary reads the basis bytes at offset used to prime a literal
+func readDictionary(basis io.ReaderAt, offset int) ([]byte, error) {
+	dict := make([]byte, dictionarySize)
+	n, err := basis.ReadAt(dict, int64(offset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return dict[:n], nil
+}
+
+func compress(data []byte, c Compression, dict []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	cw, err := newCompressor(buf, c, dict)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := cw.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := cw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompress returns the size bytes compressed in data, reading no more than that
+func decompress(data []byte, c Compression, dict []byte, size int) ([]byte, error) {
+	if size < 0 {
+		return nil, errors.New("negative literal size")
+	}
+
+	cr, err := newDecompressor(bytes.NewReader(data), c, dict)
+	if err != nil {
+		return nil, err
+	}
+	defer cr.Close()
+
+	literal, err := ioutil.ReadAll(io.LimitReader(cr, int64(size)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(literal) != size {
+		return nil, errors.New("literal does not decompress to its recorded size")
+	}
+
+	return literal, nil
+}
+
+func newCompressor(w io.Writer, c Compression, dict []byte) (io.WriteCloser, error) {
+	switch c {
+	case CompressionFlate:
+		return flate.NewWriterDict(w, flate.DefaultCompression, dict)
+	case CompressionZlib:
+		return zlib.NewWriter(w), nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	}
+
+	return nil, fmt.Errorf("unsupported compression %s", c)
+}
+
+func newDecompressor(r io.Reader, c Compression, dict []byte) (io.ReadCloser, error) {
+	switch c {
+	case CompressionFlate:
+		return flate.NewReaderDict(r, dict), nil
+	case CompressionZlib:
+		return zlib.NewReader(r)
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	}
+
+	return nil, fmt.Errorf("unsupported compression %s", c)
+}
+
+// asByteReader wraps r in a buffered reader unless it already reads single bytes
+func asByteReader(r io.Reader) io.Reader {
+	if _, ok := r.(io.ByteReader); ok {
+		return r
+	}
+
+	return bufio.NewReader(r)
+}
@@ -0,0 +1,148 @@
+package files
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func loremPatch(t *testing.T, blockSize int) ([]byte, []byte, *delta.Patch) {
+	lorem, err := ioutil.ReadFile("../../testdata/lorem-ipsum.new")
+	require.NoError(t, err)
+
+	// change a byte every 100 bytes so most of the target is literal
+	basis := lorem[:8000]
+	target := append([]byte{}, basis...)
+	for i := 0; i < len(target); i += 100 {
+		target[i] = '#'
+	}
+
+	sigs, err := delta.GenerateSignatures(bytes.NewReader(basis), blockSize)
+	require.NoError(t, err)
+
+	patch, err := delta.GeneratePatch(bytes.NewReader(target), blockSize, sigs)
+	require.NoError(t, err)
+
+	return basis, target, patch
+}
+
+func TestEncodeDelta(t *testing.T) {
+	basis, target, patch := loremPatch(t, 1024)
+
+	for _, c := range []Compression{CompressionNone, CompressionFlate, CompressionZlib, CompressionGzip} {
+		for _, perLiteral := range []bool{false, true} {
+			buf := new(bytes.Buffer)
+			err := EncodeDelta(buf, patch, &DeltaOptions{Compression: c, PerLiteral: perLiteral})
+			require.NoError(t, err)
+
+			header, res, err := DecodeDelta(buf, nil)
+			require.NoError(t, err)
+			assert.Equal(t, c, header.Compression)
+			assert.Equal(t, perLiteral, header.PerLiteral)
+
+			out := new(bytes.Buffer)
+			require.NoError(t, delta.Apply(bytes.NewReader(basis), res, out))
+			assert.Equal(t, target, out.Bytes(), "%s per literal=%v", c, perLiteral)
+		}
+	}
+}
+
+func TestEncodeDeltaDictionary(t *testing.T) {
+	basis, target, patch := loremPatch(t, 1024)
+
+	plain := new(bytes.Buffer)
+	err := EncodeDelta(plain, patch, &DeltaOptions{Compression: CompressionFlate, PerLiteral: true})
+	require.NoError(t, err)
+
+	primed := new(bytes.Buffer)
+	err = EncodeDelta(primed, patch, &DeltaOptions{Compression: CompressionFlate, PerLiteral: true, Basis: bytes.NewReader(basis)})
+	require.NoError(t, err)
+
+	// the literals compress against their old version
+	assert.Less(t, primed.Len()*2, plain.Len())
+
+	_, _, err = DecodeDelta(bytes.NewReader(primed.Bytes()), nil)
+	assert.ErrorIs(t, err, ErrBasisRequired)
+
+	header, res, err := DecodeDelta(bytes.NewReader(primed.Bytes()), bytes.NewReader(basis))
+	require.NoError(t, err)
+	assert.True(t, header.Dictionary)
+
+	out := new(bytes.Buffer)
+	require.NoError(t, delta.Apply(bytes.NewReader(basis), res, out))
+	assert.Equal(t, target, out.Bytes())
+}
+
+func TestEncodeDeltaBadOptions(t *testing.T) {
+	basis, _, patch := loremPatch(t, 1024)
+
+	err := EncodeDelta(new(bytes.Buffer), patch, &DeltaOptions{Compression: CompressionGzip, PerLiteral: true, Basis: bytes.NewReader(basis)})
+	assert.Error(t, err)
+
+	err = EncodeDelta(new(bytes.Buffer), patch, &DeltaOptions{Compression: CompressionFlate, Basis: bytes.NewReader(basis)})
+	assert.Error(t, err)
+}
+
+func TestWriteDeltaWithOptions(t *testing.T) {
+	deltaPath := filepath.Join(t.TempDir(), "lorem.delta")
+	basis, target, patch := loremPatch(t, 1024)
+
+	opts := &DeltaOptions{Compression: CompressionFlate, PerLiteral: true, Basis: bytes.NewReader(basis)}
+	require.NoError(t, WriteDeltaWithOptions(deltaPath, patch, opts))
+
+	_, err := ReadDelta(deltaPath)
+	assert.Error(t, err)
+
+	res, err := ReadDeltaWithBasis(deltaPath, bytes.NewReader(basis))
+	require.NoError(t, err)
+
+	out := new(bytes.Buffer)
+	require.NoError(t, delta.Apply(bytes.NewReader(basis), res, out))
+	assert.Equal(t, target, out.Bytes())
+}
+
+func TestParseCompression(t *testing.T) {
+	c, err := ParseCompression("GZIP")
+	assert.NoError(t, err)
+	assert.Equal(t, CompressionGzip, c)
+	assert.Equal(t, "gzip", c.String())
+
+	_, err = ParseCompression("brotli")
+	assert.Error(t, err)
+}
+
+func TestDecodeDeltaCorruptOps(t *testing.T) {
+	for _, op := range []*delta.Op{
+		{Type: delta.OpRun, Value: 1, Count: -1},
+		{Type: delta.OpCopy, Start: 8, End: 4},
+		{Type: delta.OpRun + 1},
+	} {
+		buf := new(bytes.Buffer)
+		require.NoError(t, EncodeDelta(buf, &delta.Patch{Ops: []*delta.Op{op}}, nil))
+
+		_, _, err := DecodeDelta(buf, nil)
+		assert.Error(t, err)
+	}
+}
+
+func TestDecodeDeltaLiteralSize(t *testing.T) {
+	// a small literal inflating far past the size recorded for it
+	bomb, err := compress(make([]byte, 1<<20), CompressionFlate, nil)
+	require.NoError(t, err)
+
+	for _, size := range []int{10, -1, 2 << 20} {
+		buf := new(bytes.Buffer)
+		g := gob.NewEncoder(buf)
+		require.NoError(t, g.Encode(&DeltaHeader{Version: deltaVersion, Compression: CompressionFlate, PerLiteral: true}))
+		require.NoError(t, g.Encode(&delta.Patch{Ops: []*delta.Op{{Type: delta.OpLiteral, Literal: bomb, Count: size}}}))
+
+		_, _, err := DecodeDelta(buf, nil)
+		assert.Error(t, err, "size %d", size)
+	}
+}
@@ -0,0 +1,417 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// KeySize is the size of a raw encryption key
+const KeySize = 32
+
+const (
+	// envelopeMagic starts every encrypted file
+	envelopeMagic = "RHENV\x00\x00\x01"
+	// frameSize is the amount of plaintext sealed in every frame
+	frameSize = 64 * 1024
+	// kdfIterations is the PBKDF2 iteration count of new passphrase keys
+	kdfIterations = 200000
+	// maxIterations bounds the work a crafted header can ask for
+	maxIterations = 100 * kdfIterations
+	saltSize      = 16
+	// noncePrefixSize leaves room for the frame counter and the last frame flag in the nonce
+	noncePrefixSize = 7
+	headerSize      = len(envelopeMagic) + 1 + saltSize + 4 + noncePrefixSize
+)
+
+const (
+	// kdfHMAC derives the file key from a raw key and the salt with HMAC-SHA256
+	kdfHMAC byte = iota
+	kdfPBKDF2
+)
+
+var (
+	// ErrKeyRequired is returned when reading an encrypted file without a key
+	ErrKeyRequired = errors.New("file is encrypted, a key is required")
+	// ErrNotEncrypted is returned when reading a file that is not encrypted with a key
+	ErrNotEncrypted = errors.New("file is not encrypted")
+)
+
+var errEnvelope = errors.New("encrypted file is corrupt or the key is wrong")
+
+// Key encrypts and decrypts files, either a raw key or a passphrase
+type Key struct {
+	raw        []byte
+	passphrase []byte
+}
+
+// NewKey returns a raw key of KeySize bytes
+func NewKey(raw []byte) (*Key, error) {
+	if len(raw) != KeySize {
+		return nil, errors.New("key must be 32 bytes")
+	}
+
+	return &Key{raw: raw}, nil
+}
+
+// NewPassphrase returns a key derived from a passphrase with PBKDF2-HMAC-SHA256
+func NewPassphrase(passphrase []byte) (*Key, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase can not be empty")
+	}
+
+	return &Key{passphrase: passphrase}, nil
+}
+
+// ReadKeyFile reads a raw key from a file holding either 32 bytes or 64 hex digits
+func ReadKeyFile(filename string) (*Key, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == KeySize {
+		return NewKey(data)
+	}
+
+	raw, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(raw) != KeySize {
+		return nil, errors.New("key file must hold 32 bytes or 64 hex digits")
+	}
+
+	return NewKey(raw)
+}
+
+// ReadPassphraseFile reads a passphrase from the first line of a file
+func ReadPassphraseFile(filename string) (*Key, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		data = data[:i]
+	}
+
+	return NewPassphrase(bytes.TrimSuffix(data, []byte("\r")))
+}
+
+// envelopeHeader is the plaintext header of an encrypted file, it is
+// authenticated as additional data of every frame
+type envelopeHeader struct {
+	kdf         byte
+	salt        []byte
+	iterations  uint32
+	noncePrefix []byte
+}
+
+func (h *envelopeHeader) marshal() []byte {
+	buf := make([]byte, 0, headerSize)
+	buf = append(buf, envelopeMagic...)
+	buf = append(buf, h.kdf)
+	buf = append(buf, h.salt...)
+	buf = append(buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], h.iterations)
+	return append(buf, h.noncePrefix...)
+}
+
+func unmarshalHeader(buf []byte) (*envelopeHeader, error) {
+	buf = buf[len(envelopeMagic):]
+	h := &envelopeHeader{
+		kdf:         buf[0],
+		salt:        buf[1 : 1+saltSize],
+		iterations:  binary.BigEndian.Uint32(buf[1+saltSize:]),
+		noncePrefix: buf[5+saltSize:],
+	}
+
+	if h.kdf != kdfHMAC && h.kdf != kdfPBKDF2 {
+		return nil, errors.New("unknown key derivation in encrypted file")
+	}
+
+	if h.kdf == kdfPBKDF2 && (h.iterations == 0 || h.iterations > maxIterations) {
+		return nil, errors.New("invalid key derivation in encrypted file")
+	}
+
+	return h, nil
+}
+
+// aead derives the file key described by the header from k, every file gets
+// its own key from the salt of its header
+func (k *Key) aead(h *envelopeHeader) (cipher.AEAD, error) {
+	var key []byte
+	switch {
+	case h.kdf == kdfPBKDF2 && k.passphrase != nil:
+		key = pbkdf2(k.passphrase, h.salt, int(h.iterations), KeySize)
+	case h.kdf == kdfHMAC && k.raw != nil:
+		mac := hmac.New(sha256.New, k.raw)
+		mac.Write(h.salt)
+		key = mac.Sum(nil)
+	default:
+		return nil, errors.New("file was encrypted with another kind of key")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// frameNonce returns the nonce of a frame, the last frame is flagged so a
+// truncated file does not decrypt
+func frameNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, prefix...)
+	nonce = append(nonce, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		return append(nonce, 1)
+	}
+
+	return append(nonce, 0)
+}
+
+// encryptWriter seals the stream written to it in frames of frameSize bytes
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	err     error
+}
+
+// NewEncryptWriter writes the envelope header to w and returns a writer
+// encrypting to w with AES-256-GCM. Close must be called to write the last frame,
+// it does not close w.
+func NewEncryptWriter(w io.Writer, key *Key) (io.WriteCloser, error) {
+	h := &envelopeHeader{
+		salt:        make([]byte, saltSize),
+		noncePrefix: make([]byte, noncePrefixSize),
+	}
+
+	if key.passphrase != nil {
+		h.kdf = kdfPBKDF2
+		h.iterations = kdfIterations
+	}
+
+	if _, err := rand.Read(h.salt); err != nil {
+		return nil, err
+	}
+
+	if _, err := rand.Read(h.noncePrefix); err != nil {
+		return nil, err
+	}
+
+	aead, err := key.aead(h)
+	if err != nil {
+		return nil, err
+	}
+
+	header := h.marshal()
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		prefix: h.noncePrefix,
+		buf:    make([]byte, 0, frameSize+aead.Overhead()),
+	}, nil
+}
+
+// Write implements io.Writer
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// a full frame is only sealed once more data follows, the last frame may be full
+		if len(e.buf) == frameSize {
+			if e.err = e.seal(false); e.err != nil {
+				return written, e.err
+			}
+		}
+
+		n := frameSize - len(e.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+
+		e.buf = append(e.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close seals the last frame
+func (e *encryptWriter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+
+	e.err = e.seal(true)
+	if e.err == nil {
+		e.err = errors.New("write to closed encrypted file")
+		return nil
+	}
+
+	return e.err
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.aead.Seal(e.buf[:0], frameNonce(e.prefix, e.counter, last), e.buf, e.header)
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+
+	e.counter++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// decryptReader opens the frames written by encryptWriter
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+	frame   []byte
+	plain   []byte
+	done    bool
+}
+
+// Read implements io.Reader
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.r, d.frame[:cap(d.frame)])
+	switch {
+	case err == io.EOF:
+		// the last frame is missing
+		return errEnvelope
+	case err == io.ErrUnexpectedEOF:
+		d.done = true
+	case err != nil:
+		return err
+	default:
+		if _, err := d.r.Peek(1); err == io.EOF {
+			d.done = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, err := d.aead.Open(d.frame[:0], frameNonce(d.prefix, d.counter, d.done), d.frame[:n], d.header)
+	if err != nil {
+		return errEnvelope
+	}
+
+	d.counter++
+	d.plain = plain
+	return nil
+}
+
+// OpenEnvelope returns a reader over the plaintext of r. Without a key, files
+// without the envelope header are returned as they are and encrypted files are
+// refused. With a key, only encrypted files are accepted, so a plain file can
+// not be passed off for an encrypted one.
+func OpenEnvelope(r io.Reader, key *Key) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(envelopeMagic))
+	encrypted := err == nil && string(magic) == envelopeMagic
+	switch {
+	case !encrypted && key != nil:
+		return nil, ErrNotEncrypted
+	case !encrypted:
+		// the decoder reports the errors of short files
+		return br, nil
+	case key == nil:
+		return nil, ErrKeyRequired
+	}
+
+	buf := make([]byte, headerSize)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return nil, errEnvelope
+	}
+
+	h, err := unmarshalHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := key.aead(h)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		r:      br,
+		aead:   aead,
+		header: buf,
+		prefix: h.noncePrefix,
+		frame:  make([]byte, 0, frameSize+aead.Overhead()),
+	}, nil
+}
+
+// pbkdf2 derives a key from a password as described by RFC 8018 with HMAC-SHA256
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	blocks := (keyLen + prf.Size() - 1) / prf.Size()
+
+	dk := make([]byte, 0, blocks*prf.Size())
+	u := make([]byte, prf.Size())
+	var counter [4]byte
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Write(counter[:])
+		dk = prf.Sum(dk)
+
+		t := dk[len(dk)-prf.Size():]
+		copy(u, t)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range u {
+				t[j] ^= u[j]
+			}
+		}
+	}
+
+	return dk[:keyLen]
+}
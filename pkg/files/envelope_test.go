@@ -0,0 +1,213 @@
+package files
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKey(t *testing.T) *Key {
+	raw := make([]byte, KeySize)
+	_, err := rand.Read(raw)
+	require.NoError(t, err)
+
+	key, err := NewKey(raw)
+	require.NoError(t, err)
+	return key
+}
+
+func encrypt(t *testing.T, key *Key, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	w, err := NewEncryptWriter(buf, key)
+	require.NoError(t, err)
+
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func decrypt(key *Key, data []byte) ([]byte, error) {
+	r, err := OpenEnvelope(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+func TestPBKDF2(t *testing.T) {
+	// test vectors of PBKDF2-HMAC-SHA256
+	assert.Equal(t, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b",
+		hex.EncodeToString(pbkdf2([]byte("password"), []byte("salt"), 1, 32)))
+	assert.Equal(t, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43",
+		hex.EncodeToString(pbkdf2([]byte("password"), []byte("salt"), 2, 32)))
+	assert.Equal(t, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a",
+		hex.EncodeToString(pbkdf2([]byte("password"), []byte("salt"), 4096, 32)))
+}
+
+func TestEnvelope(t *testing.T) {
+	key := testKey(t)
+
+	for _, size := range []int{0, 1, frameSize - 1, frameSize, frameSize + 1, 3*frameSize + 17} {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		sealed := encrypt(t, key, data)
+		if size > frameSize {
+			assert.False(t, bytes.Contains(sealed, data[:frameSize/2]), "size %d", size)
+		}
+
+		res, err := decrypt(key, sealed)
+		require.NoError(t, err, "size %d", size)
+		assert.Equal(t, data, res, "size %d", size)
+	}
+}
+
+func TestEnvelopeTampered(t *testing.T) {
+	key := testKey(t)
+	data := bytes.Repeat([]byte("rolling hash "), frameSize/4)
+	sealed := encrypt(t, key, data)
+
+	_, err := decrypt(testKey(t), sealed)
+	assert.Error(t, err, "wrong key")
+
+	_, err = decrypt(nil, sealed)
+	assert.ErrorIs(t, err, ErrKeyRequired)
+
+	// a missing last frame must not pass for a shorter file, 16 is the GCM tag size
+	_, err = decrypt(key, sealed[:headerSize+frameSize+16])
+	assert.Error(t, err, "truncated")
+
+	changed := append([]byte{}, sealed...)
+	changed[len(changed)-1] ^= 1
+	_, err = decrypt(key, changed)
+	assert.Error(t, err, "changed frame")
+
+	changed = append([]byte{}, sealed...)
+	changed[len(envelopeMagic)+1] ^= 1
+	_, err = decrypt(key, changed)
+	assert.Error(t, err, "changed header")
+}
+
+func TestEnvelopeSubkey(t *testing.T) {
+	key := testKey(t)
+	a, b := encrypt(t, key, []byte("data")), encrypt(t, key, []byte("data"))
+
+	// every file has its own salt
+	salt := func(sealed []byte) []byte {
+		return sealed[len(envelopeMagic)+1 : len(envelopeMagic)+1+saltSize]
+	}
+	assert.NotEqual(t, make([]byte, saltSize), salt(a))
+	assert.NotEqual(t, salt(a), salt(b))
+
+	// the frames are not sealed with the raw key itself
+	h, err := unmarshalHeader(a[:headerSize])
+	require.NoError(t, err)
+	block, err := aes.NewCipher(key.raw)
+	require.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	_, err = aead.Open(nil, frameNonce(h.noncePrefix, 0, true), a[headerSize:], a[:headerSize])
+	assert.Error(t, err)
+}
+
+func TestEnvelopePassphrase(t *testing.T) {
+	key, err := NewPassphrase([]byte("correct horse battery staple"))
+	require.NoError(t, err)
+
+	sealed := encrypt(t, key, []byte("secret"))
+	res, err := decrypt(key, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), res)
+
+	other, err := NewPassphrase([]byte("incorrect horse"))
+	require.NoError(t, err)
+	_, err = decrypt(other, sealed)
+	assert.Error(t, err)
+
+	_, err = decrypt(testKey(t), sealed)
+	assert.Error(t, err, "raw key for a passphrase file")
+}
+
+func TestReadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	raw := bytes.Repeat([]byte{7}, KeySize)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "raw"), raw, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "hex"), []byte(hex.EncodeToString(raw)+"\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "short"), raw[:16], 0600))
+
+	for _, name := range []string{"raw", "hex"} {
+		key, err := ReadKeyFile(filepath.Join(dir, name))
+		require.NoError(t, err, name)
+		assert.Equal(t, raw, key.raw, name)
+	}
+
+	_, err := ReadKeyFile(filepath.Join(dir, "short"))
+	assert.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "pass"), []byte("hunter2\n"), 0600))
+	key, err := ReadPassphraseFile(filepath.Join(dir, "pass"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hunter2"), key.passphrase)
+}
+
+func TestEncryptedFiles(t *testing.T) {
+	basis, target, patch := loremPatch(t, 1024)
+	key := testKey(t)
+	dir := t.TempDir()
+
+	sigs, err := delta.GenerateSignatures(bytes.NewReader(basis), 1024)
+	require.NoError(t, err)
+
+	sigFile := filepath.Join(dir, "sig")
+	require.NoError(t, WriteSignaturesToFileWithKey(sigFile, sigs, key))
+
+	_, err = ReadSignaturesFromFile(sigFile)
+	assert.ErrorIs(t, err, ErrKeyRequired)
+
+	res, err := ReadSignaturesFromFileWithKey(sigFile, key)
+	require.NoError(t, err)
+	assert.Len(t, res, len(sigs))
+
+	deltaFile := filepath.Join(dir, "delta")
+	require.NoError(t, WriteDeltaWithOptions(deltaFile, patch, &DeltaOptions{Compression: CompressionFlate, Key: key}))
+
+	_, err = ReadDelta(deltaFile)
+	assert.ErrorIs(t, err, ErrKeyRequired)
+
+	decoded, err := ReadDeltaWithKey(deltaFile, nil, key)
+	require.NoError(t, err)
+
+	out := new(bytes.Buffer)
+	require.NoError(t, delta.Apply(bytes.NewReader(basis), decoded, out))
+	assert.Equal(t, target, out.Bytes())
+
+	plainFile := filepath.Join(dir, "plain")
+	require.NoError(t, WriteFileWithKey(plainFile, bytes.NewReader(target), 0600, key))
+	data, err := ioutil.ReadFile(plainFile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), string(target[:64]))
+	data, err = decrypt(key, data)
+	require.NoError(t, err)
+	assert.Equal(t, target, data)
+
+	// a plain file is not taken for an encrypted one
+	require.NoError(t, WritePatch(deltaFile, patch))
+	_, err = ReadDeltaWithKey(deltaFile, nil, key)
+	assert.ErrorIs(t, err, ErrNotEncrypted)
+
+	_, err = decrypt(key, nil)
+	assert.ErrorIs(t, err, ErrNotEncrypted)
+}
@@ -1,10 +1,12 @@
 package files
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/gob"
 	"errors"
 	"io"
 	"os"
-	"encoding/gob"
 
 	"github.com/k1ng440/rolling-hash/pkg/delta"
 )
@@ -22,15 +24,166 @@ func ReadFile(filename string) (io.Reader, error) {
 	return fi, nil
 }
 
+// ReadFileAt opens the file for random access, used to read the basis
+func ReadFileAt(filename string) (*os.File, error) {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil, errors.New("file does not exist")
+	}
+
+	return os.Open(filename)
+}
+
+// WriteFile copies the content of r to a file
+func WriteFile(filename string, r io.Reader) error {
+	return WriteFileWithMode(filename, r, DefaultFileMode)
+}
+
+// WriteFileWithMode copies the content of r to a file with the given permission
+func WriteFileWithMode(filename string, r io.Reader, mode os.FileMode) error {
+	return WriteFileWithKey(filename, r, mode, nil)
+}
 
+// WriteFileWithKey copies the content of r to a file like WriteFileWithMode,
+// encrypted with key when set, see OpenEnvelope to read it back
+func WriteFileWithKey(filename string, r io.Reader, mode os.FileMode, key *Key) error {
+	fi, err := createAtomic(filename, mode)
+	if err != nil {
+		return err
+	}
+	defer fi.abort()
+
+	w, err := encryptTo(fi, key)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return fi.commit()
+}
+
+// WriteDelta encodes the deltas of GenerateDelta using gob and writes them to a file
 func WriteDelta(filename string, data map[int]*delta.Delta) error {
-	fi, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0755)
+	fi, err := createAtomic(filename, DefaultFileMode)
 	if err != nil {
 		return err
 	}
-	defer fi.Close()
+	defer fi.abort()
 
 	g := gob.NewEncoder(fi)
-	return g.Encode(data)
+	if err := g.Encode(data); err != nil {
+		return err
+	}
+
+	return fi.commit()
+}
+
+// WritePatch encodes the patch using gob and writes it to a file, see ReadDelta
+func WritePatch(filename string, data *delta.Patch) error {
+	return WriteDeltaWithOptions(filename, data, nil)
 }
 
+// WriteDeltaWithOptions encodes the patch as described by opts and writes it to a file
+func WriteDeltaWithOptions(filename string, data *delta.Patch, opts *DeltaOptions) error {
+	var key *Key
+	var mode os.FileMode
+	if opts != nil {
+		key, mode = opts.Key, opts.Mode
+	}
+
+	fi, err := createAtomic(filename, mode)
+	if err != nil {
+		return err
+	}
+	defer fi.abort()
+
+	w, err := encryptTo(fi, key)
+	if err != nil {
+		return err
+	}
+
+	if err := EncodeDelta(w, data, opts); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return fi.commit()
+}
+
+// ReadDelta reads a gob encoded patch from file
+func ReadDelta(filename string) (*delta.Patch, error) {
+	return ReadDeltaWithBasis(filename, nil)
+}
+
+// ReadDeltaWithBasis reads a patch from file, the basis is used to decompress
+// literals primed with a basis dictionary
+func ReadDeltaWithBasis(filename string, basis io.ReaderAt) (*delta.Patch, error) {
+	return ReadDeltaWithKey(filename, basis, nil)
+}
+
+// ReadDeltaWithKey reads a patch like ReadDeltaWithBasis, encrypted files are decrypted with key
+func ReadDeltaWithKey(filename string, basis io.ReaderAt, key *Key) (*delta.Patch, error) {
+	return ReadDeltaWithOptions(filename, &ReadOptions{Basis: basis, Key: key})
+}
+
+// ReadOptions controls the reading of a delta file
+type ReadOptions struct {
+	// Basis decompresses literals primed with a basis dictionary
+	Basis io.ReaderAt
+	// Key decrypts encrypted files
+	Key *Key
+	// Trusted refuses files not signed with this key when set, see SignFile
+	Trusted ed25519.PublicKey
+}
+
+// ReadDeltaWithOptions reads a patch from file as described by opts
+func ReadDeltaWithOptions(filename string, opts *ReadOptions) (*delta.Patch, error) {
+	if opts == nil {
+		opts = &ReadOptions{}
+	}
+
+	// nothing is decrypted or decoded before the signature is checked
+	content, err := ReadSigned(filename, opts.Trusted)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := OpenEnvelope(bytes.NewReader(content), opts.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	_, res, err := DecodeDelta(r, opts.Basis)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// nopWriteCloser lets unencrypted writes share the encrypted code path
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// encryptTo returns a writer encrypting to w with key, or w itself when key is nil
+func encryptTo(w io.Writer, key *Key) (io.WriteCloser, error) {
+	if key == nil {
+		return nopWriteCloser{w}, nil
+	}
+
+	return NewEncryptWriter(w, key)
+}
@@ -1,6 +1,7 @@
 package files
 
 import (
+	"bytes"
 	"io/ioutil"
 	"path"
 	"testing"
@@ -22,6 +23,18 @@ func TestReadFile(t *testing.T) {
 	assert.Equal(t, data, res)
 }
 
+func TestWriteFile(t *testing.T) {
+	tmp := path.Join(t.TempDir(), "tmp")
+	data := []byte("The quick brown fox jumps over the lazy dog")
+
+	err := WriteFile(tmp, bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	res, err := ioutil.ReadFile(tmp)
+	assert.NoError(t, err)
+	assert.Equal(t, data, res)
+}
+
 func TestWriteDelta(t *testing.T) {
 	deltaPath := path.Join(t.TempDir(), "signature.delta")
 
@@ -33,3 +46,53 @@ func TestWriteDelta(t *testing.T) {
 	err := WriteDelta(deltaPath, deltas)
 	assert.NoError(t, err)
 }
+
+func TestWritePatch(t *testing.T) {
+	deltaPath := path.Join(t.TempDir(), "signature.delta")
+
+	deltas := &delta.Patch{}
+	for i := 0; i < 10; i++ {
+		deltas.Ops = append(deltas.Ops, &delta.Op{})
+	}
+
+	err := WritePatch(deltaPath, deltas)
+	assert.NoError(t, err)
+}
+
+func TestReadDelta(t *testing.T) {
+	deltaPath := path.Join(t.TempDir(), "signature.delta")
+
+	deltas := &delta.Patch{BlockSize: 16}
+	deltas.Ops = append(deltas.Ops,
+		&delta.Op{Type: delta.OpLiteral, Literal: []byte("new ")},
+		&delta.Op{Type: delta.OpCopy, Start: 16, End: 32},
+	)
+
+	err := WritePatch(deltaPath, deltas)
+	assert.NoError(t, err)
+
+	res, err := ReadDelta(deltaPath)
+	assert.NoError(t, err)
+	assert.Equal(t, deltas, res)
+
+	_, err = ReadDelta(path.Join(t.TempDir(), "missing.delta"))
+	assert.Error(t, err)
+}
+
+func TestReadFileAt(t *testing.T) {
+	tmp := path.Join(t.TempDir(), "tmp")
+	data := []byte("The quick brown fox jumps over the lazy dog")
+	ioutil.WriteFile(tmp, data, 0644)
+
+	fi, err := ReadFileAt(tmp)
+	assert.NoError(t, err)
+	defer fi.Close()
+
+	buf := make([]byte, 5)
+	_, err = fi.ReadAt(buf, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, "quick", string(buf))
+
+	_, err = ReadFileAt(path.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,184 @@
+package files
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+)
+
+// PatchOptions controls how PatchFileWithOptions writes the rebuilt target
+type PatchOptions struct {
+	// Mode is the permission of the written file, DefaultFileMode when zero
+	Mode os.FileMode
+	// Workers applies the patch like PatchFileParallel when greater than zero
+	Workers int
+	// Resumable applies the patch like PatchFileResumable, Workers is ignored
+	Resumable bool
+}
+
+// PatchFile applies the patch on top of basis and writes the rebuilt target to filename.
+// Where sparse files are supported, runs of zeros are left as holes in the output.
+// The file only appears under filename once the rebuilt target has been verified.
+func PatchFile(filename string, basis io.ReaderAt, patch *delta.Patch) error {
+	return PatchFileWithOptions(filename, basis, patch, nil)
+}
+
+// PatchFileWithOptions applies the patch like PatchFile, as described by opts
+func PatchFileWithOptions(filename string, basis io.ReaderAt, patch *delta.Patch, opts *PatchOptions) error {
+	if opts == nil {
+		opts = &PatchOptions{}
+	}
+
+	switch {
+	case opts.Resumable:
+		return patchFileResumable(filename, basis, patch, opts.Mode)
+	case opts.Workers > 0:
+		return patchFileParallel(filename, basis, patch, opts.Workers, opts.Mode)
+	}
+
+	fi, err := createAtomic(filename, opts.Mode)
+	if err != nil {
+		return err
+	}
+	defer fi.abort()
+
+	w := &sparseWriter{fi: fi.File}
+	if err := delta.Apply(basis, patch, w); err != nil {
+		return err
+	}
+
+	if err := w.finish(); err != nil {
+		return err
+	}
+
+	return fi.commit()
+}
+
+// PatchFileParallel applies the patch like PatchFile, with the given number of
+// workers writing the operations concurrently at their offsets in the output.
+// The output is sized up front and its checksum is verified once written.
+func PatchFileParallel(filename string, basis io.ReaderAt, patch *delta.Patch, workers int) error {
+	return patchFileParallel(filename, basis, patch, workers, DefaultFileMode)
+}
+
+func patchFileParallel(filename string, basis io.ReaderAt, patch *delta.Patch, workers int, mode os.FileMode) error {
+	fi, err := createAtomic(filename, mode)
+	if err != nil {
+		return err
+	}
+	defer fi.abort()
+
+	if err := fi.Truncate(int64(patch.Size())); err != nil {
+		return err
+	}
+
+	if err := delta.ApplyParallel(basis, patch, fi.File, workers); err != nil {
+		return err
+	}
+
+	if _, err := fi.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := delta.VerifyTarget(bufio.NewReader(fi), patch); err != nil {
+		return err
+	}
+
+	return fi.commit()
+}
+
+// sparseWriter seeks over zero filled writes instead of writing them
+type sparseWriter struct {
+	fi     *os.File
+	offset int64
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	if !sparseFiles || !isZero(p) {
+		n, err := w.fi.Write(p)
+		w.offset += int64(n)
+		return n, err
+	}
+
+	if _, err := w.fi.Seek(int64(len(p)), io.SeekCurrent); err != nil {
+		return 0, err
+	}
+
+	w.offset += int64(len(p))
+	return len(p), nil
+}
+
+// finish sets the file size, a trailing hole is not allocated by seeking
+func (w *sparseWriter) finish() error {
+	return w.fi.Truncate(w.offset)
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return len(p) > 0
+}
+
+// WriteRanges writes one "start end" line for every range to a file
+func WriteRanges(filename string, ranges []delta.Range) error {
+	return WriteRangesWithMode(filename, ranges, DefaultFileMode)
+}
+
+// WriteRangesWithMode writes the ranges like WriteRanges to a file with the given permission
+func WriteRangesWithMode(filename string, ranges []delta.Range, mode os.FileMode) error {
+	fi, err := createAtomic(filename, mode)
+	if err != nil {
+		return err
+	}
+	defer fi.abort()
+
+	w := bufio.NewWriter(fi)
+	for _, r := range ranges {
+		if _, err := fmt.Fprintf(w, "%d %d\n", r.Start, r.End); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return fi.commit()
+}
+
+// PatchFileInPlace applies the patch to the basis file itself, without a second
+// copy of the file. The file is truncated or extended to the size of the target
+// and its checksum is verified once done. Unlike PatchFile, an interrupted
+// in place patch leaves a broken file behind.
+func PatchFileInPlace(filename string, patch *delta.Patch) error {
+	fi, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	if err := delta.ApplyInPlace(fi, patch); err != nil {
+		return err
+	}
+
+	if err := fi.Truncate(int64(patch.Size())); err != nil {
+		return err
+	}
+
+	if err := fi.Sync(); err != nil {
+		return err
+	}
+
+	if _, err := fi.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return delta.VerifyTarget(bufio.NewReader(fi), patch)
+}
@@ -0,0 +1,136 @@
+package files
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatchFile(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "new")
+	basis := []byte("The quick brown fox jumps over the lazy dog")
+
+	patch := &delta.Patch{
+		Ops: []*delta.Op{
+			{Type: delta.OpCopy, Start: 0, End: 10},
+			{Type: delta.OpRun, Value: 0, Count: 1 << 20},
+			{Type: delta.OpLiteral, Literal: []byte("red")},
+			{Type: delta.OpCopy, Start: 15, End: 20},
+			{Type: delta.OpRun, Value: 0, Count: 1 << 20},
+		},
+	}
+
+	err := PatchFile(outPath, bytes.NewReader(basis), patch)
+	require.NoError(t, err)
+
+	expected := new(bytes.Buffer)
+	require.NoError(t, delta.Apply(bytes.NewReader(basis), patch, expected))
+
+	res, err := ioutil.ReadFile(outPath)
+	require.NoError(t, err)
+	assert.Equal(t, expected.Bytes(), res)
+}
+
+func TestPatchFileParallel(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "new")
+	basis := []byte("The quick brown fox jumps over the lazy dog")
+
+	sigs, err := delta.GenerateSignatures(bytes.NewReader(basis), 4)
+	require.NoError(t, err)
+
+	target := []byte("The quick red fox jumps over the lazy dog, the lazy dog")
+	patch, err := delta.GeneratePatch(bytes.NewReader(target), 4, sigs)
+	require.NoError(t, err)
+
+	require.NoError(t, PatchFileParallel(outPath, bytes.NewReader(basis), patch, 4))
+
+	res, err := ioutil.ReadFile(outPath)
+	require.NoError(t, err)
+	assert.Equal(t, target, res)
+
+	// the output is left alone when the target does not match
+	patch.TargetHash[0] ^= 0xff
+	err = PatchFileParallel(outPath, bytes.NewReader(basis), patch, 4)
+	assert.ErrorIs(t, err, delta.ErrTargetMismatch)
+
+	res, err = ioutil.ReadFile(outPath)
+	require.NoError(t, err)
+	assert.Equal(t, target, res)
+}
+
+func TestPatchFileShortBasis(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "new")
+	patch := &delta.Patch{
+		Ops: []*delta.Op{{Type: delta.OpCopy, Start: 0, End: 10}},
+	}
+
+	err := PatchFile(outPath, bytes.NewReader([]byte("short")), patch)
+	assert.Error(t, err)
+}
+
+func TestPatchFileMismatch(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "new")
+	basis := []byte("The quick brown fox jumps over the lazy dog")
+
+	sigs, err := delta.GenerateSignatures(bytes.NewReader(basis), 16)
+	require.NoError(t, err)
+
+	patch, err := delta.GeneratePatch(bytes.NewReader([]byte("The quick red fox jumps over the lazy dog")), 16, sigs)
+	require.NoError(t, err)
+
+	err = PatchFile(outPath, bytes.NewReader([]byte("The quick brown cat jumps over the lazy dog")), patch)
+	assert.ErrorIs(t, err, delta.ErrBasisMismatch)
+	assert.NoFileExists(t, outPath)
+
+	patch.TargetHash[0] ^= 0xff
+	err = PatchFile(outPath, bytes.NewReader(basis), patch)
+	assert.ErrorIs(t, err, delta.ErrTargetMismatch)
+	assert.NoFileExists(t, outPath)
+}
+
+func TestWriteRanges(t *testing.T) {
+	reportPath := filepath.Join(t.TempDir(), "report")
+
+	err := WriteRanges(reportPath, []delta.Range{{Start: 0, End: 16}, {Start: 64, End: 100}})
+	require.NoError(t, err)
+
+	res, err := ioutil.ReadFile(reportPath)
+	require.NoError(t, err)
+	assert.Equal(t, "0 16\n64 100\n", string(res))
+}
+
+func TestPatchFileInPlace(t *testing.T) {
+	basis, err := ioutil.ReadFile("../../testdata/lorem-ipsum.new")
+	require.NoError(t, err)
+
+	targets := map[string][]byte{
+		"shrink": append(append([]byte{}, basis[4000:]...), basis[:3000]...),
+		"extend": append(append([]byte{}, basis[10000:]...), basis...),
+	}
+
+	for name, target := range targets {
+		t.Run(name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "lorem")
+			require.NoError(t, ioutil.WriteFile(filePath, basis, 0644))
+
+			sigs, err := delta.GenerateSignatures(bytes.NewReader(basis), 512)
+			require.NoError(t, err)
+			patch, err := delta.GeneratePatch(bytes.NewReader(target), 512, sigs)
+			require.NoError(t, err)
+
+			require.NoError(t, PatchFileInPlace(filePath, patch))
+
+			res, err := ioutil.ReadFile(filePath)
+			require.NoError(t, err)
+			assert.Equal(t, target, res)
+
+			// the file is not the basis of the patch anymore
+			assert.ErrorIs(t, PatchFileInPlace(filePath, patch), delta.ErrBasisMismatch)
+		})
+	}
+}
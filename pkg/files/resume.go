@@ -0,0 +1,233 @@
+package files
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+)
+
+// journalInterval is the number of output bytes written between two journal updates
+const journalInterval = 8 * 1024 * 1024
+
+const (
+	// partSuffix is appended to the output name while a resumable patch is in progress
+	partSuffix = ".part"
+	// journalSuffix is appended to the output name for the progress journal
+	journalSuffix = ".journal"
+)
+
+// patchJournal records the progress of a resumable patch
+type patchJournal struct {
+	// BasisHash, TargetHash and Size identify the patch being applied
+	BasisHash  []byte
+	TargetHash []byte
+	Size       int
+	// Op is the number of operations completed
+	Op int
+	// Offset is the number of output bytes written and synced
+	Offset int
+	// Checksum is the sha256 of the output up to Offset
+	Checksum []byte
+}
+
+// matches reports whether the journal was written for the patch
+func (j *patchJournal) matches(patch *delta.Patch) bool {
+	return bytes.Equal(j.BasisHash, patch.BasisHash) &&
+		bytes.Equal(j.TargetHash, patch.TargetHash) &&
+		j.Size == patch.Size() &&
+		j.Offset <= j.Size &&
+		j.Op == completedOps(patch, j.Offset)
+}
+
+// PatchFileResumable applies the patch like PatchFile, but survives interruptions.
+// The output is written to filename.part and the progress is recorded in
+// filename.journal, both synced every few megabytes. When they are found on the
+// next call for the same patch, the partial output is checked against the journal
+// and patching continues from the last recorded offset.
+func PatchFileResumable(filename string, basis io.ReaderAt, patch *delta.Patch) error {
+	return patchFileResumable(filename, basis, patch, DefaultFileMode)
+}
+
+func patchFileResumable(filename string, basis io.ReaderAt, patch *delta.Patch, mode os.FileMode) error {
+	if mode == 0 {
+		mode = DefaultFileMode
+	}
+
+	if err := delta.VerifyBasis(basis, patch); err != nil {
+		return err
+	}
+
+	partName := filename + partSuffix
+	journalName := filename + journalSuffix
+
+	fi, err := os.OpenFile(partName, os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	if err := fi.Chmod(mode); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	offset, err := resumeOffset(fi, journalName, patch, h)
+	if err != nil {
+		return err
+	}
+
+	// drop whatever was written after the last journal update
+	if err := fi.Truncate(int64(offset)); err != nil {
+		return err
+	}
+
+	if _, err := fi.Seek(int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+
+	w := &sparseWriter{fi: fi, offset: int64(offset)}
+	for size := patch.Size(); offset < size; {
+		end := offset + journalInterval
+		if end > size {
+			end = size
+		}
+
+		if err := delta.ApplyRange(basis, patch, io.MultiWriter(w, h), offset, end); err != nil {
+			return err
+		}
+		offset = end
+
+		if err := w.finish(); err != nil {
+			return err
+		}
+
+		if err := fi.Sync(); err != nil {
+			return err
+		}
+
+		err := writeJournal(journalName, &patchJournal{
+			BasisHash:  patch.BasisHash,
+			TargetHash: patch.TargetHash,
+			Size:       size,
+			Op:         completedOps(patch, offset),
+			Offset:     offset,
+			Checksum:   h.Sum(nil),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// a wrong output can not be fixed by resuming, start over next time
+	if patch.TargetHash != nil && !bytes.Equal(h.Sum(nil), patch.TargetHash) {
+		fi.Close()
+		os.Remove(partName)
+		os.Remove(journalName)
+		return delta.ErrTargetMismatch
+	}
+
+	if err := fi.Sync(); err != nil {
+		return err
+	}
+
+	if err := fi.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(partName, filename); err != nil {
+		return err
+	}
+
+	if err := syncDir(filepath.Dir(filename)); err != nil {
+		return err
+	}
+
+	// an empty target is done before any journal is written
+	if err := os.Remove(journalName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// resumeOffset checks the partial output against the journal and returns the
+// offset to continue from, with h holding the checksum of the output before it.
+// Without a journal for the patch, or when the partial output does not match it,
+// the output is written from the start.
+func resumeOffset(fi *os.File, journalName string, patch *delta.Patch, h hash.Hash) (int, error) {
+	j, err := readJournal(journalName)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil || !j.matches(patch) {
+		return 0, nil
+	}
+
+	if _, err := fi.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	if _, err := io.CopyN(h, fi, int64(j.Offset)); err != nil {
+		h.Reset()
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	if !bytes.Equal(h.Sum(nil), j.Checksum) {
+		h.Reset()
+		return 0, nil
+	}
+
+	return j.Offset, nil
+}
+
+// completedOps returns the number of operations written entirely before offset
+func completedOps(patch *delta.Patch, offset int) int {
+	end := 0
+	for i, op := range patch.Ops {
+		end += op.Len()
+		if end > offset {
+			return i
+		}
+	}
+
+	return len(patch.Ops)
+}
+
+func readJournal(filename string) (*patchJournal, error) {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	j := &patchJournal{}
+	if err := gob.NewDecoder(fi).Decode(j); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func writeJournal(filename string, j *patchJournal) error {
+	fi, err := createAtomic(filename, DefaultFileMode)
+	if err != nil {
+		return err
+	}
+	defer fi.abort()
+
+	if err := gob.NewEncoder(fi).Encode(j); err != nil {
+		return err
+	}
+
+	return fi.commit()
+}
@@ -0,0 +1,107 @@
+package files
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var resumeBasis = []byte("The quick brown fox jumps over the lazy dog")
+
+func resumePatch() *delta.Patch {
+	return &delta.Patch{
+		Ops: []*delta.Op{
+			{Type: delta.OpCopy, Start: 0, End: 10},
+			{Type: delta.OpLiteral, Literal: []byte("red")},
+			{Type: delta.OpCopy, Start: 15, End: 43},
+		},
+	}
+}
+
+// interrupt leaves the output of an interrupted patch, with partial written to disk
+// and the journal recording offset
+func interrupt(t *testing.T, outPath string, patch *delta.Patch, partial []byte, offset int) {
+	require.NoError(t, ioutil.WriteFile(outPath+partSuffix, partial, 0644))
+
+	sum := sha256.Sum256(partial[:offset])
+	require.NoError(t, writeJournal(outPath+journalSuffix, &patchJournal{
+		Size:     patch.Size(),
+		Op:       completedOps(patch, offset),
+		Offset:   offset,
+		Checksum: sum[:],
+	}))
+}
+
+func TestPatchFileResumable(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "new")
+
+	require.NoError(t, PatchFileResumable(outPath, bytes.NewReader(resumeBasis), resumePatch()))
+
+	res, err := ioutil.ReadFile(outPath)
+	require.NoError(t, err)
+	assert.Equal(t, "The quick red fox jumps over the lazy dog", string(res))
+
+	assert.NoFileExists(t, outPath+partSuffix)
+	assert.NoFileExists(t, outPath+journalSuffix)
+}
+
+func TestPatchFileResume(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "new")
+	patch := resumePatch()
+
+	// the recorded output is kept and the bytes written after the journal are dropped
+	interrupt(t, outPath, patch, []byte("THE QUICK rXXXXX"), 11)
+	require.NoError(t, PatchFileResumable(outPath, bytes.NewReader(resumeBasis), patch))
+
+	res, err := ioutil.ReadFile(outPath)
+	require.NoError(t, err)
+	assert.Equal(t, "THE QUICK red fox jumps over the lazy dog", string(res))
+}
+
+func TestPatchFileResumeMismatch(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "new")
+	patch := resumePatch()
+
+	// the partial output changed after the journal was written
+	interrupt(t, outPath, patch, []byte("THE QUICK r"), 11)
+	require.NoError(t, ioutil.WriteFile(outPath+partSuffix, []byte("the quick r"), 0644))
+	require.NoError(t, PatchFileResumable(outPath, bytes.NewReader(resumeBasis), patch))
+
+	res, err := ioutil.ReadFile(outPath)
+	require.NoError(t, err)
+	assert.Equal(t, "The quick red fox jumps over the lazy dog", string(res))
+
+	// the journal was written for another patch
+	interrupt(t, outPath, patch, []byte("THE QUICK r"), 11)
+	other := resumePatch()
+	other.Ops = append(other.Ops, &delta.Op{Type: delta.OpLiteral, Literal: []byte("!")})
+	require.NoError(t, PatchFileResumable(outPath, bytes.NewReader(resumeBasis), other))
+
+	res, err = ioutil.ReadFile(outPath)
+	require.NoError(t, err)
+	assert.Equal(t, "The quick red fox jumps over the lazy dog!", string(res))
+}
+
+func TestPatchFileResumableTargetMismatch(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "new")
+
+	sigs, err := delta.GenerateSignatures(bytes.NewReader(resumeBasis), 16)
+	require.NoError(t, err)
+
+	patch, err := delta.GeneratePatch(bytes.NewReader([]byte("The quick red fox jumps over the lazy dog")), 16, sigs)
+	require.NoError(t, err)
+	patch.TargetHash[0] ^= 0xff
+
+	err = PatchFileResumable(outPath, bytes.NewReader(resumeBasis), patch)
+	assert.ErrorIs(t, err, delta.ErrTargetMismatch)
+
+	assert.NoFileExists(t, outPath)
+	assert.NoFileExists(t, outPath+partSuffix)
+	assert.NoFileExists(t, outPath+journalSuffix)
+}
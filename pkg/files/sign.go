@@ -0,0 +1,252 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	// signedMagic starts every signed file
+	signedMagic      = "RHSIG\x00\x00\x01"
+	signedHeaderSize = len(signedMagic) + 8 + ed25519.SignatureSize
+)
+
+var (
+	// ErrUnsigned is returned when a trusted key is given for a file without signature
+	ErrUnsigned = errors.New("file is not signed")
+	// ErrBadSignature is returned when the signature of a file does not match the trusted key
+	ErrBadSignature = errors.New("file signature does not match the trusted key")
+)
+
+// signedMessage is the message signed for a file, the magic binds the
+// signature to the format and the size and digest to the signed content
+func signedMessage(size uint64, digest []byte) []byte {
+	msg := make([]byte, 0, len(signedMagic)+8+len(digest))
+	msg = append(msg, signedMagic...)
+	msg = append(msg, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(msg[len(signedMagic):], size)
+	return append(msg, digest...)
+}
+
+// SignFile attaches an Ed25519 signature over the content of a file, usually a
+// delta file, replacing its previous signature. Encrypted files are signed as
+// they are, so the signature can be checked without the key.
+func SignFile(filename string, priv ed25519.PrivateKey) error {
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	content, err := OpenSigned(src, nil)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, content)
+	if err != nil {
+		return err
+	}
+
+	// the header is the message without the digest followed by the signature
+	msg := signedMessage(uint64(size), h.Sum(nil))
+	header := append(msg[:len(signedMagic)+8:len(signedMagic)+8], ed25519.Sign(priv, msg)...)
+
+	// read the content a second time to copy it behind the signature
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if content, err = OpenSigned(src, nil); err != nil {
+		return err
+	}
+
+	// the signed file keeps its permission
+	fi, err := createAtomic(filename, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer fi.abort()
+
+	if _, err := fi.Write(header); err != nil {
+		return err
+	}
+
+	n, err := io.Copy(fi, content)
+	if err != nil {
+		return err
+	}
+
+	if n != size {
+		return errors.New("file changed while signing")
+	}
+
+	return fi.commit()
+}
+
+// VerifyFile checks the signature of a file against the trusted key
+func VerifyFile(filename string, trusted ed25519.PublicKey) error {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	r, err := OpenSigned(fi, trusted)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// ReadSigned reads the content of a signed or unsigned file once, see OpenSigned.
+// With a trusted key the content is only returned once its signature is checked,
+// so callers decode exactly the bytes that were verified.
+func ReadSigned(filename string, trusted ed25519.PublicKey) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := OpenSigned(bytes.NewReader(data), trusted)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+// verifyingReader hashes the signed content and checks the signature once
+// the content is read, returning ErrBadSignature instead of io.EOF on mismatch
+type verifyingReader struct {
+	r         io.Reader
+	h         hash.Hash
+	trusted   ed25519.PublicKey
+	size      uint64
+	read      uint64
+	signature []byte
+}
+
+// Read implements io.Reader
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	v.read += uint64(n)
+
+	if err == io.EOF {
+		if v.read != v.size || !ed25519.Verify(v.trusted, signedMessage(v.size, v.h.Sum(nil)), v.signature) {
+			return n, ErrBadSignature
+		}
+	}
+
+	return n, err
+}
+
+// OpenSigned returns a reader over the content of a signed or unsigned file.
+// Without a trusted key the signature is skipped, with one unsigned files are
+// refused and the signature is checked when the content is read to the end.
+func OpenSigned(r io.Reader, trusted ed25519.PublicKey) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(signedMagic))
+	if err != nil || string(magic) != signedMagic {
+		if trusted != nil {
+			return nil, ErrUnsigned
+		}
+
+		return br, nil
+	}
+
+	header := make([]byte, signedHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, ErrBadSignature
+	}
+
+	if trusted == nil {
+		return br, nil
+	}
+
+	return &verifyingReader{
+		r:         br,
+		h:         sha256.New(),
+		trusted:   trusted,
+		size:      binary.BigEndian.Uint64(header[len(signedMagic):]),
+		signature: header[len(signedMagic)+8:],
+	}, nil
+}
+
+// WriteSigningKeys generates an Ed25519 key pair and writes it hex encoded to
+// the private and public key files
+func WriteSigningKeys(privFilename, pubFilename string) error {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+
+	// the private key is never readable by others
+	fi, err := createAtomic(privFilename, 0600)
+	if err != nil {
+		return err
+	}
+	defer fi.abort()
+
+	if _, err := fi.WriteString(hex.EncodeToString(priv.Seed()) + "\n"); err != nil {
+		return err
+	}
+
+	if err := fi.commit(); err != nil {
+		return err
+	}
+
+	return WriteFile(pubFilename, bytes.NewReader([]byte(hex.EncodeToString(pub)+"\n")))
+}
+
+// ReadPrivateKeyFile reads an Ed25519 private key written by WriteSigningKeys
+func ReadPrivateKeyFile(filename string) (ed25519.PrivateKey, error) {
+	seed, err := readHexFile(filename, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ReadPublicKeyFile reads an Ed25519 public key written by WriteSigningKeys
+func ReadPublicKeyFile(filename string) (ed25519.PublicKey, error) {
+	pub, err := readHexFile(filename, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	return ed25519.PublicKey(pub), nil
+}
+
+func readHexFile(filename string, size int) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(raw) != size {
+		return nil, errors.New("invalid key file " + filename)
+	}
+
+	return raw, nil
+}
@@ -0,0 +1,132 @@
+package files
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignFile(t *testing.T) {
+	_, _, patch := loremPatch(t, 1024)
+	dir := t.TempDir()
+
+	privFile := filepath.Join(dir, "key")
+	pubFile := filepath.Join(dir, "key.pub")
+	require.NoError(t, WriteSigningKeys(privFile, pubFile))
+
+	info, err := os.Stat(privFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	priv, err := ReadPrivateKeyFile(privFile)
+	require.NoError(t, err)
+	pub, err := ReadPublicKeyFile(pubFile)
+	require.NoError(t, err)
+
+	deltaFile := filepath.Join(dir, "delta")
+	require.NoError(t, WriteDeltaWithOptions(deltaFile, patch, &DeltaOptions{Compression: CompressionFlate}))
+
+	_, err = ReadDeltaWithOptions(deltaFile, &ReadOptions{Trusted: pub})
+	assert.ErrorIs(t, err, ErrUnsigned)
+
+	require.NoError(t, SignFile(deltaFile, priv))
+	require.NoError(t, VerifyFile(deltaFile, pub))
+
+	res, err := ReadDeltaWithOptions(deltaFile, &ReadOptions{Trusted: pub})
+	require.NoError(t, err)
+	assert.Equal(t, patch.TargetHash, res.TargetHash)
+
+	// signed files still read without a trusted key
+	_, err = ReadDelta(deltaFile)
+	assert.NoError(t, err)
+
+	// signing again replaces the signature
+	require.NoError(t, SignFile(deltaFile, priv))
+	require.NoError(t, VerifyFile(deltaFile, pub))
+
+	other, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	assert.ErrorIs(t, VerifyFile(deltaFile, other), ErrBadSignature)
+	_, err = ReadDeltaWithOptions(deltaFile, &ReadOptions{Trusted: other})
+	assert.ErrorIs(t, err, ErrBadSignature)
+}
+
+func TestSignFileTampered(t *testing.T) {
+	_, _, patch := loremPatch(t, 1024)
+	dir := t.TempDir()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	deltaFile := filepath.Join(dir, "delta")
+	require.NoError(t, WritePatch(deltaFile, patch))
+	require.NoError(t, SignFile(deltaFile, priv))
+
+	data, err := ioutil.ReadFile(deltaFile)
+	require.NoError(t, err)
+
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)-10] ^= 1
+
+	for name, changed := range map[string][]byte{
+		"changed byte": flipped,
+		"truncated":    data[:len(data)-1],
+		"appended":     append(append([]byte{}, data...), 0),
+	} {
+		require.NoError(t, ioutil.WriteFile(deltaFile, changed, 0644))
+
+		assert.ErrorIs(t, VerifyFile(deltaFile, pub), ErrBadSignature, name)
+		_, err = ReadDeltaWithOptions(deltaFile, &ReadOptions{Trusted: pub})
+		assert.ErrorIs(t, err, ErrBadSignature, name)
+	}
+}
+
+func TestReadSigned(t *testing.T) {
+	dir := t.TempDir()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	filename := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("content"), 0644))
+	require.NoError(t, SignFile(filename, priv))
+
+	content, err := ReadSigned(filename, pub)
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(content))
+
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 1
+	require.NoError(t, ioutil.WriteFile(filename, data, 0644))
+
+	_, err = ReadSigned(filename, pub)
+	assert.ErrorIs(t, err, ErrBadSignature)
+
+	// without a trusted key the signature is skipped
+	content, err = ReadSigned(filename, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "contenu", string(content))
+}
+
+func TestSignEncryptedFile(t *testing.T) {
+	_, _, patch := loremPatch(t, 1024)
+	dir := t.TempDir()
+	key := testKey(t)
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	deltaFile := filepath.Join(dir, "delta")
+	require.NoError(t, WriteDeltaWithOptions(deltaFile, patch, &DeltaOptions{Key: key}))
+	require.NoError(t, SignFile(deltaFile, priv))
+
+	// the signature is checked without the key
+	require.NoError(t, VerifyFile(deltaFile, pub))
+
+	res, err := ReadDeltaWithOptions(deltaFile, &ReadOptions{Key: key, Trusted: pub})
+	require.NoError(t, err)
+	assert.Equal(t, patch.TargetHash, res.TargetHash)
+}
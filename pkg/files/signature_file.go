@@ -14,33 +14,80 @@ func WriteSignaturesToFile(filename string, signatures []*delta.BlockSignature)
 		return errors.New("can not write empty signatures to file")
 	}
 
-	fi, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0755)
+	return WriteSignaturesToFileWithKey(filename, signatures, nil)
+}
+
+// SignatureOptions controls how WriteSignaturesToFileWithOptions writes signatures
+type SignatureOptions struct {
+	// Key encrypts the file when set, see NewEncryptWriter
+	Key *Key
+	// Mode is the permission of the file, DefaultFileMode when zero
+	Mode os.FileMode
+}
+
+// WriteSignaturesToFileWithKey writes the signatures like WriteSignaturesToFile,
+// encrypted with key unless it is nil. Unlike WriteSignaturesToFile it writes
+// the empty signatures of an empty basis, see ReadSignaturesFromFileWithKey.
+func WriteSignaturesToFileWithKey(filename string, signatures []*delta.BlockSignature, key *Key) error {
+	return WriteSignaturesToFileWithOptions(filename, signatures, &SignatureOptions{Key: key})
+}
+
+// WriteSignaturesToFileWithOptions writes the signatures like WriteSignaturesToFileWithKey,
+// as described by opts
+func WriteSignaturesToFileWithOptions(filename string, signatures []*delta.BlockSignature, opts *SignatureOptions) error {
+	if opts == nil {
+		opts = &SignatureOptions{}
+	}
+
+	fi, err := createAtomic(filename, opts.Mode)
+	if err != nil {
+		return err
+	}
+	defer fi.abort()
+
+	w, err := encryptTo(fi, opts.Key)
 	if err != nil {
 		return err
 	}
-	defer fi.Close()
 
-	g := gob.NewEncoder(fi)
-	return g.Encode(signatures)
+	g := gob.NewEncoder(w)
+	if err := g.Encode(signatures); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return fi.commit()
 }
 
 // ReadSignaturesFromFile reads gob encoded signatures from file 
 // returns error if file not found or contains invalid signatures
 func ReadSignaturesFromFile(filename string) ([]*delta.BlockSignature, error) {
+	return ReadSignaturesFromFileWithKey(filename, nil)
+}
+
+// ReadSignaturesFromFileWithKey reads signatures like ReadSignaturesFromFile,
+// encrypted files are decrypted with key. The signatures of an empty basis
+// are empty.
+func ReadSignaturesFromFileWithKey(filename string, key *Key) ([]*delta.BlockSignature, error) {
 	var res []*delta.BlockSignature
 
 	fi, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	defer fi.Close()
 
-	g := gob.NewDecoder(fi)
-	if err := g.Decode(&res); err != nil {
+	r, err := OpenEnvelope(fi, key)
+	if err != nil {
 		return nil, err
 	}
 
-	if len(res) == 0 {
-		return nil, errors.New("the file does not contains valid signatures")
+	g := gob.NewDecoder(r)
+	if err := g.Decode(&res); err != nil {
+		return nil, err
 	}
 
 	return res, nil
@@ -68,3 +68,14 @@ func TestReadSignature(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestEmptySignatures(t *testing.T) {
+	sigPath := filepath.Join(t.TempDir(), "empty.sig")
+
+	err := WriteSignaturesToFileWithKey(sigPath, []*delta.BlockSignature{}, nil)
+	assert.NoError(t, err)
+
+	sigs, err := ReadSignaturesFromFile(sigPath)
+	assert.NoError(t, err)
+	assert.Empty(t, sigs)
+}
@@ -0,0 +1,35 @@
+package files
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatchFileSparse(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "sparse")
+	patch := &delta.Patch{
+		Ops: []*delta.Op{
+			{Type: delta.OpLiteral, Literal: []byte("head")},
+			{Type: delta.OpRun, Value: 0, Count: 64 << 20},
+			{Type: delta.OpLiteral, Literal: []byte("tail")},
+		},
+	}
+
+	err := PatchFile(outPath, bytes.NewReader(nil), patch)
+	require.NoError(t, err)
+
+	info, err := os.Stat(outPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(patch.Size()), info.Size())
+
+	// the run is a hole, only the blocks around it are allocated
+	stat := info.Sys().(*syscall.Stat_t)
+	assert.Less(t, stat.Blocks*512, int64(1<<20))
+}
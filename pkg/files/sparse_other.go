@@ -0,0 +1,6 @@
+//go:build !linux
+
+package files
+
+// sparseFiles reports whether zero runs are written as holes
+const sparseFiles = false
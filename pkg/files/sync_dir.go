@@ -0,0 +1,16 @@
+//go:build !windows
+
+package files
+
+import "os"
+
+// syncDir flushes the directory entries of dir to disk, making a rename durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,6 @@
+package files
+
+// syncDir is a no-op, directories can not be flushed on windows
+func syncDir(dir string) error {
+	return nil
+}
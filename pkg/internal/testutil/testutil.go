@@ -0,0 +1,98 @@
+// Package testutil holds the fixtures shared by the tests of the other packages
+package testutil
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// RandomBytes returns n pseudo random bytes, the same for the same seed
+func RandomBytes(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// WriteFile writes a file, creating its directory when needed
+func WriteFile(t *testing.T, path string, data []byte) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+}
+
+// WriteTree writes the files of tree under root, keyed by slash separated paths
+func WriteTree(t *testing.T, root string, tree map[string][]byte) {
+	for name, data := range tree {
+		WriteFile(t, filepath.Join(root, filepath.FromSlash(name)), data)
+	}
+}
+
+// Snapshot describes a tree: file contents, modes, times and symlink targets.
+// Directory times are only recorded with dirTimes.
+func Snapshot(t *testing.T, root string, dirTimes bool) map[string]string {
+	tree := make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		require.NoError(t, err)
+		rel, err := filepath.Rel(root, path)
+		require.NoError(t, err)
+
+		switch {
+		case info.IsDir() && dirTimes:
+			tree[rel] = "dir " + info.Mode().Perm().String() + " " + info.ModTime().UTC().String()
+		case info.IsDir():
+			tree[rel] = "dir " + info.Mode().Perm().String()
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			require.NoError(t, err)
+			tree[rel] = "link " + target
+		default:
+			data, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			tree[rel] = info.Mode().Perm().String() + " " + info.ModTime().UTC().String() + " " + string(data)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return tree
+}
+
+// CopyTree copies the files, directories and symlinks of src to dst with their metadata
+func CopyTree(t *testing.T, src, dst string) {
+	dirs := make([]string, 0)
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		require.NoError(t, err)
+		rel, err := filepath.Rel(src, path)
+		require.NoError(t, err)
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			require.NoError(t, os.MkdirAll(target, 0755))
+			dirs = append(dirs, rel)
+			return nil
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			require.NoError(t, err)
+			require.NoError(t, os.Symlink(link, target))
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(target, data, info.Mode().Perm()))
+		require.NoError(t, os.Chtimes(target, info.ModTime(), info.ModTime()))
+		return nil
+	})
+	require.NoError(t, err)
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Stat(filepath.Join(src, dirs[i]))
+		require.NoError(t, err)
+		require.NoError(t, os.Chmod(filepath.Join(dst, dirs[i]), info.Mode().Perm()))
+		require.NoError(t, os.Chtimes(filepath.Join(dst, dirs[i]), info.ModTime(), info.ModTime()))
+	}
+}
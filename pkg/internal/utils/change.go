@@ -0,0 +1,21 @@
+package utils
+
+// ChangeKind is the kind of difference of a path between two trees
+type ChangeKind uint8
+
+const (
+	Added ChangeKind = iota
+	Removed
+	Modified
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "+"
+	case Removed:
+		return "-"
+	}
+
+	return "M"
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"crypto/sha256"
 	"io"
 	"os"
 )
@@ -61,3 +62,24 @@ func ReadFile(filename string, blockSize int) chan *File {
 
 	return c
 }
+
+// HashFile returns the sha256 hash of the content of a file
+func HashFile(filename string) ([]byte, error) {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fi); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// FileKind returns the type bits of a file mode, zero for regular files
+func FileKind(mode os.FileMode) os.FileMode {
+	return mode & os.ModeType
+}
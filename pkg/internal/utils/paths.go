@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrSymlink is returned for paths reaching an entry through a symlink
+var ErrSymlink = errors.New("path goes through a symlink")
+
+// LocalPath checks that a slash separated path names an entry inside a tree,
+// as recorded in bundles, batches and snapshots, and returns it with the
+// separators of the system. Paths must be clean and relative, the root itself
+// is refused.
+func LocalPath(p string) (string, error) {
+	clean := path.Clean(p)
+	if p == "" || clean != p || path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+
+	return filepath.FromSlash(clean), nil
+}
+
+// JoinPath joins a slash separated directory and a name, the root is the empty path
+func JoinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+
+	return dir + "/" + name
+}
+
+// CheckParents checks that no parent directory of the local path p under root
+// is a symlink. A path checked only lexically could otherwise follow a symlink
+// written earlier into the tree and reach files outside of it. Missing parents
+// are accepted, nothing is reached through them.
+func CheckParents(root, p string) error {
+	dir := root
+	parts := strings.Split(p, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%q: %w", p, ErrSymlink)
+		}
+	}
+
+	return nil
+}
+
+// CheckNotSymlink refuses a path naming a symlink, where changing the content
+// or the metadata of the entry would change the file the symlink points to
+func CheckNotSymlink(path string) error {
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%q is a symlink", path)
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalPath(t *testing.T) {
+	for _, p := range []string{"", ".", "..", "../x", "/etc/passwd", "a/../../b", "a//b", "a/", "a/./b"} {
+		_, err := LocalPath(p)
+		assert.Error(t, err, p)
+	}
+
+	local, err := LocalPath("a/b")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("a", "b"), local)
+}
+
+func TestCheckParents(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "a", "b"), 0755))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "a", "link")))
+
+	for _, p := range []string{"", "a", filepath.Join("a", "b", "c"), filepath.Join("missing", "x", "y"), filepath.Join("a", "link")} {
+		assert.NoError(t, CheckParents(root, p), p)
+	}
+
+	for _, p := range []string{filepath.Join("a", "link", "x"), filepath.Join("a", "link", "b", "x")} {
+		assert.ErrorIs(t, CheckParents(root, p), ErrSymlink, p)
+	}
+
+	assert.Error(t, CheckNotSymlink(filepath.Join(root, "a", "link")))
+	assert.NoError(t, CheckNotSymlink(filepath.Join(root, "a", "b")))
+	assert.NoError(t, CheckNotSymlink(filepath.Join(root, "missing")))
+}
@@ -0,0 +1,440 @@
+// Package store keeps the versions of files as reverse deltas
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/k1ng440/rolling-hash/pkg/files"
+)
+
+// DefaultKeyframeInterval is the number of versions between two versions kept in full
+const DefaultKeyframeInterval = 16
+
+// versionsFile is the name of the version log of every file
+const versionsFile = "versions"
+
+var (
+	// ErrNotFound is returned for files and versions not in the store
+	ErrNotFound = errors.New("version not found")
+	// ErrCorrupt is returned at the end of a version whose content does not match its hash
+	ErrCorrupt = errors.New("stored version does not match its hash")
+)
+
+// Version describes a stored version of a file
+type Version struct {
+	Number int
+	Size   int64
+	Time   time.Time
+	// Hash is the sha256 hash of the content
+	Hash []byte
+	// Keyframe versions are kept in full
+	Keyframe bool
+}
+
+// Store keeps the versions of files in a local directory. The newest version of
+// every file is kept in full, older versions as reverse deltas from the version
+// following them, and every KeyframeInterval versions one is kept in full so that
+// old versions do not need long delta chains.
+//
+// With a Key, the versions, deltas and version logs are encrypted. File names
+// and the number of versions are not hidden, and versions kept in full are
+// decrypted in memory when a delta is computed against them or applied to them.
+type Store struct {
+	dir string
+	// KeyframeInterval is the number of versions between two keyframes, 0 disables keyframes
+	KeyframeInterval int
+	// BlockSize is the block size of the reverse deltas
+	BlockSize int
+	// Mode is the permission of the files written to the store
+	Mode os.FileMode
+	// Key encrypts the files of the store when set, a store is read with the key it was written with
+	Key *files.Key
+}
+
+// New opens the store in dir, creating the directory when needed
+func New(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		dir:              dir,
+		KeyframeInterval: DefaultKeyframeInterval,
+		BlockSize:        delta.DefaultBlockSize,
+		Mode:             files.DefaultFileMode,
+	}, nil
+}
+
+// Put stores the content of r as the newest version of name and returns it
+func (s *Store) Put(name string, r io.Reader) (*Version, error) {
+	versions, err := s.List(name)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(s.fileDir(name), 0755); err != nil {
+		return nil, err
+	}
+
+	number := 1
+	if len(versions) > 0 {
+		number = versions[len(versions)-1].Number + 1
+	}
+
+	v := &Version{
+		Number:   number,
+		Time:     time.Now(),
+		Keyframe: s.KeyframeInterval > 0 && number%s.KeyframeInterval == 0,
+	}
+
+	h := sha256.New()
+	c := &countWriter{}
+
+	if err := files.WriteFileWithKey(s.fullPath(name, v.Number), io.TeeReader(r, io.MultiWriter(h, c)), s.Mode, s.Key); err != nil {
+		return nil, err
+	}
+	v.Hash = h.Sum(nil)
+	v.Size = c.n
+
+	if len(versions) > 0 {
+		if err := s.reverse(name, v.Number); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.writeVersions(name, append(versions, v)); err != nil {
+		return nil, err
+	}
+
+	// the previous version is rebuilt from the new one from now on
+	if len(versions) > 0 && !versions[len(versions)-1].Keyframe {
+		if err := os.Remove(s.fullPath(name, v.Number-1)); err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+// reverse writes the delta rebuilding the version before number from number
+func (s *Store) reverse(name string, number int) error {
+	target, err := s.openFull(name, number)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	sigs, err := delta.GenerateSignatures(bufio.NewReader(target), s.BlockSize)
+	if err != nil {
+		return err
+	}
+
+	previous, err := s.openFull(name, number-1)
+	if err != nil {
+		return err
+	}
+	defer previous.Close()
+
+	patch, err := delta.GeneratePatchWithBasis(bufio.NewReader(previous), s.BlockSize, sigs, target)
+	if err != nil {
+		return err
+	}
+
+	return files.WriteDeltaWithOptions(s.deltaPath(name, number-1), patch, &files.DeltaOptions{
+		Compression: files.CompressionFlate,
+		Key:         s.Key,
+		Mode:        s.Mode,
+	})
+}
+
+// Get returns a reader over the content of a version of name. Versions not kept
+// in full are rebuilt on the fly from the closest newer version kept in full.
+// The content is checked against the hash of the version, reading to the end
+// returns ErrCorrupt instead of io.EOF when it does not match.
+func (s *Store) Get(name string, number int) (io.ReadCloser, error) {
+	versions, err := s.List(name)
+	if err != nil {
+		return nil, err
+	}
+
+	first := versions[0].Number
+	last := versions[len(versions)-1].Number
+	if number < first || number > last {
+		return nil, ErrNotFound
+	}
+
+	// the closest newer version kept in full
+	full := number
+	for full < last && !versions[full-first].Keyframe {
+		full++
+	}
+
+	basis, err := s.openFull(name, full)
+	if err != nil {
+		return nil, err
+	}
+
+	if full == number {
+		return newVersionReader(basis, basis, versions[number-first]), nil
+	}
+
+	patch, err := s.chain(name, full, number)
+	if err == nil {
+		err = delta.VerifyBasis(basis, patch)
+	}
+
+	var r *delta.PatchedReader
+	if err == nil {
+		r, err = delta.NewPatchedReader(basis, patch)
+	}
+
+	if err != nil {
+		basis.Close()
+		return nil, err
+	}
+
+	return newVersionReader(r, basis, versions[number-first]), nil
+}
+
+// chain composes the reverse deltas going from version full back to number
+func (s *Store) chain(name string, full, number int) (*delta.Patch, error) {
+	patch, err := files.ReadDeltaWithKey(s.deltaPath(name, full-1), nil, s.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	for v := full - 2; v >= number; v-- {
+		next, err := files.ReadDeltaWithKey(s.deltaPath(name, v), nil, s.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		if patch, err = delta.Compose(patch, next); err != nil {
+			return nil, err
+		}
+	}
+
+	return patch, nil
+}
+
+// List returns the stored versions of name, oldest first
+func (s *Store) List(name string) ([]*Version, error) {
+	fi, err := os.Open(filepath.Join(s.fileDir(name), versionsFile))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	r, err := s.open(fi)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]*Version, 0)
+	if err := gob.NewDecoder(r).Decode(&versions); err != nil {
+		return nil, err
+	}
+
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return versions, nil
+}
+
+// Names returns the names of the stored files
+func (s *Store) Names() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name, err := hex.DecodeString(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		names = append(names, string(name))
+	}
+
+	return names, nil
+}
+
+// Prune drops all but the newest keep versions of every file
+func (s *Store) Prune(keep int) error {
+	if keep < 1 {
+		return errors.New("at least one version must be kept")
+	}
+
+	names, err := s.Names()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := s.prune(name, keep); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) prune(name string, keep int) error {
+	versions, err := s.List(name)
+	if err != nil {
+		return err
+	}
+
+	if len(versions) <= keep {
+		return nil
+	}
+
+	dropped := versions[:len(versions)-keep]
+	if err := s.writeVersions(name, versions[len(versions)-keep:]); err != nil {
+		return err
+	}
+
+	// the newest version is kept, every dropped one has a delta or is a keyframe
+	for _, v := range dropped {
+		for _, filename := range []string{s.deltaPath(name, v.Number), s.fullPath(name, v.Number)} {
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) writeVersions(name string, versions []*Version) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(versions); err != nil {
+		return err
+	}
+
+	return files.WriteFileWithKey(filepath.Join(s.fileDir(name), versionsFile), buf, s.Mode, s.Key)
+}
+
+// open returns a reader over the plaintext of a file of the store, encrypted
+// files are refused without a key and plain files with one
+func (s *Store) open(fi *os.File) (io.Reader, error) {
+	return files.OpenEnvelope(fi, s.Key)
+}
+
+// openFull opens a version kept in full. Encrypted versions are decrypted in
+// memory, deltas need random access to them.
+func (s *Store) openFull(name string, number int) (fullVersion, error) {
+	fi, err := os.Open(s.fullPath(name, number))
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Key == nil {
+		return fi, nil
+	}
+	defer fi.Close()
+
+	r, err := s.open(fi)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return plainVersion{bytes.NewReader(data)}, nil
+}
+
+// fileDir returns the directory holding the versions of name, names are hex
+// encoded to stay valid file names
+func (s *Store) fileDir(name string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(name)))
+}
+
+func (s *Store) fullPath(name string, number int) string {
+	return filepath.Join(s.fileDir(name), fmt.Sprintf("%d.full", number))
+}
+
+func (s *Store) deltaPath(name string, number int) string {
+	return filepath.Join(s.fileDir(name), fmt.Sprintf("%d.delta", number))
+}
+
+// fullVersion is the content of a version kept in full
+type fullVersion interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+}
+
+// plainVersion is a decrypted version kept in full
+type plainVersion struct {
+	*bytes.Reader
+}
+
+func (plainVersion) Close() error {
+	return nil
+}
+
+// versionReader reads a version and checks it against its hash at the end,
+// closing it closes the version it is read or rebuilt from
+type versionReader struct {
+	r     io.Reader
+	basis io.Closer
+	h     hash.Hash
+	hash  []byte
+}
+
+func newVersionReader(r io.Reader, basis io.Closer, v *Version) *versionReader {
+	return &versionReader{
+		r:     r,
+		basis: basis,
+		h:     sha256.New(),
+		hash:  v.Hash,
+	}
+}
+
+func (r *versionReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.h.Sum(nil), r.hash) {
+		return n, ErrCorrupt
+	}
+
+	return n, err
+}
+
+func (r *versionReader) Close() error {
+	return r.basis.Close()
+}
+
+// countWriter counts the bytes written to it
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
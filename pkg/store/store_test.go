@@ -0,0 +1,201 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/k1ng440/rolling-hash/pkg/delta"
+	"github.com/k1ng440/rolling-hash/pkg/files"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// versions returns n versions of a file, every one a small edit of the previous one
+func versions(n int) [][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	current := make([]byte, 64*1024)
+	rnd.Read(current)
+
+	result := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		next := append([]byte{}, current...)
+		at := rnd.Intn(len(next))
+		edit := make([]byte, 100)
+		rnd.Read(edit)
+		next = append(next[:at], append(edit, next[at:]...)...)
+
+		result = append(result, next)
+		current = next
+	}
+
+	return result
+}
+
+func get(t *testing.T, s *Store, name string, number int) []byte {
+	r, err := s.Get(name, number)
+	require.NoError(t, err)
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return data
+}
+
+func TestStore(t *testing.T) {
+	s, err := New(t.TempDir())
+	require.NoError(t, err)
+	s.KeyframeInterval = 4
+
+	contents := versions(10)
+	for i, content := range contents {
+		v, err := s.Put("dir/file.bin", bytes.NewReader(content))
+		require.NoError(t, err)
+		assert.Equal(t, i+1, v.Number)
+		assert.Equal(t, int64(len(content)), v.Size)
+		assert.Equal(t, (i+1)%4 == 0, v.Keyframe)
+	}
+
+	for i, content := range contents {
+		assert.Equal(t, content, get(t, s, "dir/file.bin", i+1), "version %d", i+1)
+	}
+
+	list, err := s.List("dir/file.bin")
+	require.NoError(t, err)
+	assert.Len(t, list, 10)
+
+	names, err := s.Names()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dir/file.bin"}, names)
+
+	_, err = s.Get("dir/file.bin", 11)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = s.Get("missing", 1)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestStorePrune(t *testing.T) {
+	s, err := New(t.TempDir())
+	require.NoError(t, err)
+	s.KeyframeInterval = 3
+
+	contents := versions(8)
+	for _, content := range contents {
+		_, err := s.Put("file", bytes.NewReader(content))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, s.Prune(3))
+
+	list, err := s.List("file")
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+	assert.Equal(t, 6, list[0].Number)
+
+	_, err = s.Get("file", 5)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	for number := 6; number <= 8; number++ {
+		assert.Equal(t, contents[number-1], get(t, s, "file", number))
+	}
+
+	// the dropped versions are gone from disk
+	entries, err := ioutil.ReadDir(s.fileDir("file"))
+	require.NoError(t, err)
+
+	left := make([]string, 0)
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+	assert.Equal(t, []string{"6.delta", "6.full", "7.delta", "8.full", versionsFile}, left)
+
+	// new versions keep numbering after the pruned ones
+	v, err := s.Put("file", bytes.NewReader(contents[0]))
+	require.NoError(t, err)
+	assert.Equal(t, 9, v.Number)
+	assert.Equal(t, contents[7], get(t, s, "file", 8))
+
+	assert.Error(t, s.Prune(0))
+}
+
+func TestStoreCorrupt(t *testing.T) {
+	s, err := New(t.TempDir())
+	require.NoError(t, err)
+	s.KeyframeInterval = 0
+
+	contents := versions(3)
+	for _, content := range contents {
+		_, err := s.Put("file", bytes.NewReader(content))
+		require.NoError(t, err)
+	}
+
+	// a copy moved in a reverse delta is only caught by the version hash
+	patch, err := files.ReadDelta(s.deltaPath("file", 2))
+	require.NoError(t, err)
+	require.Equal(t, delta.OpCopy, patch.Ops[0].Type)
+	patch.Ops[0].Start++
+	patch.Ops[0].End++
+	require.NoError(t, files.WriteDeltaWithOptions(s.deltaPath("file", 2), patch, &files.DeltaOptions{Compression: files.CompressionFlate}))
+
+	for _, number := range []int{1, 2} {
+		r, err := s.Get("file", number)
+		require.NoError(t, err)
+		_, err = ioutil.ReadAll(r)
+		assert.ErrorIs(t, err, ErrCorrupt, "version %d", number)
+		require.NoError(t, r.Close())
+	}
+
+	// so is a change to the version kept in full
+	data := append([]byte{}, contents[2]...)
+	data[0] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(s.fullPath("file", 3), data, 0644))
+
+	r, err := s.Get("file", 3)
+	require.NoError(t, err)
+	defer r.Close()
+	_, err = ioutil.ReadAll(r)
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestStoreEncrypted(t *testing.T) {
+	raw := make([]byte, files.KeySize)
+	raw[0] = 1
+	key, err := files.NewKey(raw)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	s, err := New(dir)
+	require.NoError(t, err)
+	s.KeyframeInterval = 2
+	s.Key = key
+
+	contents := versions(5)
+	for _, content := range contents {
+		_, err := s.Put("file", bytes.NewReader(content))
+		require.NoError(t, err)
+	}
+
+	for i, content := range contents {
+		assert.Equal(t, content, get(t, s, "file", i+1), "version %d", i+1)
+	}
+
+	// no stored file holds the content of a version
+	entries, err := ioutil.ReadDir(s.fileDir("file"))
+	require.NoError(t, err)
+	for _, entry := range entries {
+		data, err := ioutil.ReadFile(filepath.Join(s.fileDir("file"), entry.Name()))
+		require.NoError(t, err)
+		for _, content := range contents {
+			assert.False(t, bytes.Contains(data, content[:256]), entry.Name())
+		}
+	}
+
+	// the store is not readable without its key
+	plain, err := New(dir)
+	require.NoError(t, err)
+	_, err = plain.List("file")
+	assert.ErrorIs(t, err, files.ErrKeyRequired)
+}